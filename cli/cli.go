@@ -58,6 +58,31 @@ func NewCli() *cli.App {
 			Name:  "quiet",
 			Usage: "Suppresses extra output from iptb",
 		},
+		cli.StringFlag{
+			Name:   "format",
+			Value:  "text",
+			EnvVar: "IPTB_FORMAT",
+			Usage:  "Output format, one of text, json or ndjson",
+		},
+		cli.IntFlag{
+			Name:   "concurrency",
+			EnvVar: "IPTB_CONCURRENCY",
+			Usage:  "Maximum number of nodes acted on at once, 0 for no limit (event streams are not limited)",
+		},
+		cli.StringFlag{
+			Name:   "timeout",
+			EnvVar: "IPTB_TIMEOUT",
+			Usage:  "Maximum duration of the whole command, e.g. 5m",
+		},
+		cli.IntFlag{
+			Name:   "allow-failures",
+			EnvVar: "IPTB_ALLOW_FAILURES",
+			Usage:  "Number of nodes allowed to fail before iptb exits with an error",
+		},
+		cli.BoolFlag{
+			Name:  "fail-fast",
+			Usage: "Cancel the remaining nodes once a node failed",
+		},
 		cli.StringFlag{
 			Name:   "IPTB_ROOT",
 			EnvVar: "IPTB_ROOT",
@@ -66,6 +91,22 @@ func NewCli() *cli.App {
 	}
 	app.Before = func(c *cli.Context) error {
 		flagRoot := c.GlobalString("IPTB_ROOT")
+		flagFormat := c.GlobalString("format")
+		flagTimeout := c.GlobalString("timeout")
+
+		if err := commands.ValidateFormat(flagFormat); err != nil {
+			return err
+		}
+
+		// Kept for reporting errors once the command returned
+		c.App.Metadata["format"] = flagFormat
+
+		timeout, err := commands.ParseTimeout(flagTimeout)
+		if err != nil {
+			return err
+		}
+
+		c.App.Metadata["context"] = commands.NewRootContext(timeout)
 
 		if len(flagRoot) == 0 {
 			home := os.Getenv("HOME")
@@ -96,14 +137,26 @@ func NewCli() *cli.App {
 		commands.StopCmd,
 		commands.RestartCmd,
 		commands.RunCmd,
+		commands.WaitCmd,
+		commands.WaitForCmd,
+		commands.WaitEventCmd,
 		commands.ConnectCmd,
+		commands.DisconnectCmd,
 		commands.ShellCmd,
 
+		commands.NetnsCmd,
+		commands.PartitionCmd,
+		commands.HealCmd,
+		commands.TopologyCmd,
+
 		commands.AttrCmd,
 
 		commands.LogsCmd,
 		commands.EventsCmd,
 		commands.MetricCmd,
+		commands.HealthCmd,
+
+		commands.ScenarioCmd,
 	}
 
 	// https://github.com/urfave/cli/issues/736
@@ -120,6 +173,10 @@ func NewCli() *cli.App {
 		}
 	*/
 
+	// Errors are left for the caller of Run to report, see
+	// commands.WriteError, so they can follow the output format
+	app.ExitErrHandler = func(c *cli.Context, err error) {}
+
 	app.ErrWriter = os.Stderr
 	app.Writer = os.Stdout
 
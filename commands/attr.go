@@ -2,6 +2,7 @@ package commands
 
 import (
 	"fmt"
+	"io"
 	"path"
 	"strconv"
 
@@ -91,6 +92,8 @@ var AttrGetCmd = cli.Command{
 		flagRoot := c.GlobalString("IPTB_ROOT")
 		flagTestbed := c.GlobalString("testbed")
 
+		flagFormat := c.GlobalString("format")
+
 		if c.NArg() != 2 {
 			return NewUsageError("get takes exactly 2 argument")
 		}
@@ -120,9 +123,16 @@ var AttrGetCmd = cli.Command{
 			return err
 		}
 
-		_, err = fmt.Fprintf(c.App.Writer, "%s\n", value)
+		rec := valueRecord{
+			Node:  i,
+			Name:  argAttr,
+			Value: value,
+		}
 
-		return err
+		return writeFormatted(c.App.Writer, flagFormat, rec, func(w io.Writer) error {
+			_, err := fmt.Fprintf(w, "%s\n", value)
+			return err
+		})
 	},
 }
 
@@ -141,6 +151,7 @@ var AttrListCmd = cli.Command{
 		flagRoot := c.GlobalString("IPTB_ROOT")
 		flagTestbed := c.GlobalString("testbed")
 		flagType := c.String("type")
+		flagFormat := c.GlobalString("format")
 
 		if !c.Args().Present() && len(flagType) == 0 {
 			return NewUsageError("specify a node, or a type")
@@ -167,16 +178,25 @@ var AttrListCmd = cli.Command{
 			return fmt.Errorf("unknown plugin %s", flagType)
 		}
 
-		attrList := plg.GetAttrList()
-		for _, a := range attrList {
+		var recs []descRecord
+		for _, a := range plg.GetAttrList() {
 			desc, err := plg.GetAttrDesc(a)
 			if err != nil {
 				return fmt.Errorf("error getting attribute description: %s", err)
 			}
 
-			fmt.Fprintf(c.App.Writer, "\t%s: %s\n", a, desc)
+			recs = append(recs, descRecord{
+				Name:        a,
+				Description: desc,
+			})
 		}
 
-		return nil
+		return writeFormatted(c.App.Writer, flagFormat, recs, func(w io.Writer) error {
+			for _, r := range recs {
+				fmt.Fprintf(w, "\t%s: %s\n", r.Name, r.Description)
+			}
+
+			return nil
+		})
 	},
 }
@@ -8,6 +8,7 @@ import (
 
 	"github.com/ipfs/iptb/testbed"
 	testbedi "github.com/ipfs/iptb/testbed/interfaces"
+	"github.com/ipfs/iptb/testbed/netns"
 )
 
 var AutoCmd = cli.Command{
@@ -52,6 +53,8 @@ $ iptb auto           -count 5 -type <type>
 		flagRoot := c.GlobalString("IPTB_ROOT")
 		flagTestbed := c.GlobalString("testbed")
 		flagQuiet := c.GlobalBool("quiet")
+		flagFormat := c.GlobalString("format")
+		flagAllowFailures := c.GlobalInt("allow-failures")
 		flagType := c.String("type")
 		flagStart := c.Bool("start")
 		flagCount := c.Int("count")
@@ -77,39 +80,53 @@ $ iptb auto           -count 5 -type <type>
 			return err
 		}
 
+		nw, err := netns.Load(tb.Dir())
+		if err != nil {
+			return err
+		}
+
 		var list []int
 		for i := range nodes {
 			list = append(list, i)
 		}
 
-		runCmd := func(node testbedi.Core) (testbedi.Output, error) {
-			return node.Init(context.Background())
+		runCmd := func(ctx context.Context, n int, node testbedi.Core) (testbedi.Output, error) {
+			return node.Init(ctx)
 		}
 
-		results, err := mapWithOutput(list, nodes, runCmd)
+		m, err := newMapper(c)
 		if err != nil {
 			return err
 		}
 
-		if err := buildReport(results, flagQuiet); err != nil {
+		results, err := m.mapWithOutput(list, nodes, inNetns(nw, runCmd))
+		if err != nil {
 			return err
 		}
 
-		if flagStart {
-			runCmd := func(node testbedi.Core) (testbedi.Output, error) {
-				return node.Start(context.Background(), true)
+		// Nodes are only started when initialization did not fail, both
+		// steps are reported together so the output is a single report
+		if flagStart && checkFailures(results, flagAllowFailures) == nil {
+			r := newReadiness(readyInterval, readyTimeout)
+
+			runCmd := func(ctx context.Context, n int, node testbedi.Core) (testbedi.Output, error) {
+				return r.start(ctx, n, node, true, nil)
 			}
 
-			results, err := mapWithOutput(list, nodes, runCmd)
+			m, err := newMapper(c)
 			if err != nil {
 				return err
 			}
 
-			if err := buildReport(results, flagQuiet); err != nil {
+			started, err := m.mapWithOutput(list, nodes, inNetns(nw, runCmd))
+			if err != nil {
 				return err
 			}
+
+			r.record(started)
+			results = append(results, started...)
 		}
 
-		return nil
+		return buildReport(results, flagQuiet, flagFormat, flagAllowFailures)
 	},
 }
@@ -17,3 +17,7 @@ type UsageError struct {
 func (e *UsageError) Error() string {
 	return fmt.Sprintf("Usage Error: %s", e.s)
 }
+
+func (e *UsageError) ExitCode() int {
+	return ExitUsage
+}
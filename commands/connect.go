@@ -3,10 +3,15 @@ package commands
 import (
 	"context"
 	"fmt"
+	"io"
+	"math/rand"
+	"os"
 	"path"
+	"strings"
 	"time"
 
 	"github.com/ipfs/iptb/testbed"
+	"github.com/ipfs/iptb/testbed/netns"
 	cli "github.com/urfave/cli"
 )
 
@@ -38,21 +43,83 @@ INPUT         EXPANDED
 [0,2-4]       0,2,3,4
 [2-4,0]       2,3,4,0
 [0,2,4]       0,2,4
+
+Instead of connecting every node of the first set to every node of the
+second, nodes may be connected following a topology, over all nodes or over a
+single set of nodes:
+
+$ iptb connect --topology ring
+$ iptb connect --topology random:3 --seed 42 [0-99]
+
+TOPOLOGY                 EDGES
+line                     i => i+1
+ring                     i => i+1, and the last node to the first
+star:<hub>               every node to the hub (default: first node)
+tree:<fanout>            every node to its parent in a tree of given fanout
+random:<degree>          every node to at least <degree> random nodes
+erdos-renyi:<p>          every pair of nodes with probability <p>
+small-world:<k>,<beta>   Watts-Strogatz ring of <k> neighbours, rewired with
+                         probability <beta>
+scale-free:<m>           Barabasi-Albert, every node to <m> nodes by degree
+
+Random topologies print the seed they used, which can be passed back with
+--seed to reproduce a run.
+
+An explicit list of edges can also be loaded from a file, with one pair of
+node indexes per line:
+
+$ cat edges.txt
+0 1
+1 2
+$ iptb connect --edges edges.txt
+
+Connections are made concurrently, up to the global --concurrency at a time.
+A failed connection is retried up to --retries times, waiting --backoff before
+the first retry and twice as long before every following one. Every pair,
+retries included, is bounded by --timeout.
 `,
 	Flags: []cli.Flag{
 		cli.StringFlag{
 			Name:  "timeout",
-			Usage: "timeout on the command",
+			Usage: "maximum duration of every pair, retries included",
 			Value: "30s",
 		},
+		cli.StringFlag{
+			Name:  "topology",
+			Usage: "connect nodes following a named topology",
+		},
+		cli.StringFlag{
+			Name:  "edges",
+			Usage: "connect nodes following an edge list read from a file",
+		},
+		cli.Int64Flag{
+			Name:  "seed",
+			Usage: "seed for random topologies",
+		},
+		cli.IntFlag{
+			Name:  "retries",
+			Usage: "number of times a failed connection is retried",
+			Value: 0,
+		},
+		cli.StringFlag{
+			Name:  "backoff",
+			Usage: "delay before the first retry, doubled after every retry",
+			Value: "1s",
+		},
 	},
 	Action: func(c *cli.Context) error {
 		flagRoot := c.GlobalString("IPTB_ROOT")
 		flagTestbed := c.GlobalString("testbed")
 		flagQuiet := c.GlobalBool("quiet")
-		flagTimeout := c.String("timeout")
+		flagFormat := c.GlobalString("format")
+		flagAllowFailures := c.GlobalInt("allow-failures")
+		flagTopology := c.String("topology")
+		flagEdges := c.String("edges")
+		flagSeed := c.Int64("seed")
+		flagRetries := c.Int("retries")
+		flagBackoff := c.String("backoff")
 
-		timeout, err := time.ParseDuration(flagTimeout)
+		backoff, err := time.ParseDuration(flagBackoff)
 		if err != nil {
 			return err
 		}
@@ -60,85 +127,291 @@ INPUT         EXPANDED
 		tb := testbed.NewTestbed(path.Join(flagRoot, "testbeds", flagTestbed))
 		args := c.Args()
 
-		var results []Result
-		switch c.NArg() {
-		case 0:
-			nodes, err := tb.Nodes()
-			if err != nil {
-				return err
+		nodes, err := tb.Nodes()
+		if err != nil {
+			return err
+		}
+
+		var edges []edge
+		switch {
+		case flagTopology != "" && flagEdges != "":
+			return NewUsageError("topology and edges can not be used together")
+		case flagEdges != "":
+			if c.NArg() != 0 {
+				return NewUsageError("connect accepts no arguments with edges")
 			}
 
-			fromto, err := parseRange(fmt.Sprintf("[0-%d]", len(nodes)-1))
+			fi, err := os.Open(flagEdges)
 			if err != nil {
 				return err
 			}
+			defer fi.Close()
 
-			results, err = connectNodes(tb, fromto, fromto, timeout)
+			edges, err = readEdges(fi)
 			if err != nil {
 				return err
 			}
-		case 1:
-			fromto, err := parseRange(args[0])
-			if err != nil {
-				return err
+		case flagTopology != "":
+			nodeRange := fmt.Sprintf("[0-%d]", len(nodes)-1)
+			switch c.NArg() {
+			case 0:
+			case 1:
+				nodeRange = args[0]
+			default:
+				return NewUsageError("connect accepts between 0 and 1 arguments with a topology")
 			}
 
-			results, err = connectNodes(tb, fromto, fromto, timeout)
+			list, err := parseRange(nodeRange)
 			if err != nil {
 				return err
 			}
-		case 2:
-			from, err := parseRange(args[0])
-			if err != nil {
-				return err
+
+			if !c.IsSet("seed") {
+				flagSeed = time.Now().UnixNano()
+				if !flagQuiet && isRandomTopology(flagTopology) {
+					fmt.Fprintf(c.App.ErrWriter, "topology seed: %d\n", flagSeed)
+				}
 			}
 
-			to, err := parseRange(args[1])
+			edges, err = buildTopology(flagTopology, list, rand.New(rand.NewSource(flagSeed)))
 			if err != nil {
 				return err
 			}
+		default:
+			switch c.NArg() {
+			case 0:
+				fromto, err := parseRange(fmt.Sprintf("[0-%d]", len(nodes)-1))
+				if err != nil {
+					return err
+				}
 
-			results, err = connectNodes(tb, from, to, timeout)
-			if err != nil {
+				edges = bipartite(fromto, fromto)
+			case 1:
+				fromto, err := parseRange(args[0])
+				if err != nil {
+					return err
+				}
+
+				edges = bipartite(fromto, fromto)
+			case 2:
+				from, err := parseRange(args[0])
+				if err != nil {
+					return err
+				}
+
+				to, err := parseRange(args[1])
+				if err != nil {
+					return err
+				}
+
+				edges = bipartite(from, to)
+			default:
+				return NewUsageError("connet accepts between 0 and 2 arguments")
+			}
+		}
+
+		m, err := newMapper(c)
+		if err != nil {
+			return err
+		}
+
+		connected, err := connectNodes(m, tb, edges, connectOptions{
+			Retries: flagRetries,
+			Backoff: backoff,
+		})
+		if err != nil {
+			return err
+		}
+
+		if err := recordTopology(tb, connectedEdges(connected), true); err != nil {
+			return err
+		}
+
+		var results []Result
+		for _, r := range connected {
+			results = append(results, Result{
+				Node:     r.From,
+				Output:   nil,
+				Error:    r.Error,
+				Duration: r.Latency,
+			})
+		}
+
+		if flagFormat != formatText {
+			var records []connectRecord
+			for _, r := range connected {
+				records = append(records, connectRecord{
+					From:      r.From,
+					To:        r.To,
+					Attempts:  r.Attempts,
+					LatencyMs: durationMs(r.Latency),
+					Error:     NewErrorRecord(r.Error),
+				})
+			}
+
+			if err := writeFormatted(c.App.Writer, flagFormat, records, nil); err != nil {
 				return err
 			}
-		default:
-			return NewUsageError("connet accepts between 0 and 2 arguments")
+
+			return checkFailures(results, flagAllowFailures)
 		}
 
-		return buildReport(results, flagQuiet)
+		if !flagQuiet {
+			connectReport(c.App.Writer, c.App.ErrWriter, connected)
+		}
+
+		return checkFailures(results, flagAllowFailures)
 	},
 }
 
-func connectNodes(tb testbed.BasicTestbed, from, to []int, timeout time.Duration) ([]Result, error) {
-	var results []Result
+func isRandomTopology(spec string) bool {
+	switch name, _, _ := strings.Cut(spec, ":"); name {
+	case "random", "erdos-renyi", "small-world", "scale-free":
+		return true
+	}
+
+	return false
+}
+
+// connectOptions controls how connectNodes retries pairs of nodes
+type connectOptions struct {
+	// Retries is the number of attempts made after the first one fails
+	Retries int
+	// Backoff is the delay before the first retry, doubled after every retry
+	Backoff time.Duration
+}
+
+// connectResult reports on the connection of one pair of nodes
+type connectResult struct {
+	edge
+	// Attempts made, the last one is the only one which may have succeeded
+	Attempts int
+	// Latency of the last attempt
+	Latency time.Duration
+	Error   error
+}
 
+// connectNodes connects every pair of edges through m, retrying failed pairs.
+// Pairs listed more than once are connected once.
+func connectNodes(m *mapper, tb testbed.BasicTestbed, edges []edge, opts connectOptions) ([]connectResult, error) {
 	nodes, err := tb.Nodes()
 	if err != nil {
-		return results, err
+		return nil, err
 	}
 
-	for _, f := range from {
-		for _, t := range to {
-			if f == t {
-				continue
-			}
+	var results []connectResult
+	byEdge := make(map[edge]*connectResult)
+	for _, e := range edges {
+		if err := validRange([]int{e.From, e.To}, len(nodes)); err != nil {
+			return nil, err
+		}
 
-			ctx, cancel := context.WithTimeout(context.Background(), timeout)
-			defer cancel()
+		if _, ok := byEdge[e]; !ok {
+			byEdge[e] = nil
+			results = append(results, connectResult{edge: e})
+		}
+	}
 
-			err = nodes[f].Connect(ctx, nodes[t])
-			if err != nil {
-				err = fmt.Errorf("node[%d] => node[%d]: %w", f, t, err)
-			}
+	pairs := make([][2]int, len(results))
+	for i := range results {
+		byEdge[results[i].edge] = &results[i]
+		pairs[i] = [2]int{results[i].From, results[i].To}
+	}
 
-			results = append(results, Result{
-				Node:   f,
-				Output: nil,
-				Error:  err,
+	nw, err := netns.Load(tb.Dir())
+	if err != nil {
+		return nil, err
+	}
+
+	parts, err := testbed.ReadPartitions(tb.Dir())
+	if err != nil {
+		return nil, err
+	}
+
+	mapped := m.mapPairs(pairs, "=>", func(ctx context.Context, from, to int) error {
+		if p, ok := testbed.Separated(parts, from, to); ok {
+			return fmt.Errorf("separated by partition %d", p.ID)
+		}
+
+		res := byEdge[edge{from, to}]
+		backoff := opts.Backoff
+
+		for {
+			res.Attempts++
+
+			start := time.Now()
+			err := execNetns(nw, nodes[from].Dir(), func() error {
+				return nodes[from].Connect(ctx, nodes[to])
 			})
+			res.Latency = time.Since(start)
+
+			if err == nil || res.Attempts > opts.Retries {
+				return err
+			}
+
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return err
+			}
+
+			backoff *= 2
 		}
+	})
+
+	for i, rs := range mapped {
+		results[i].Error = rs.Error
 	}
 
 	return results, nil
 }
+
+// connectedEdges returns the edges of the pairs which connected
+func connectedEdges(results []connectResult) []edge {
+	var out []edge
+	for _, r := range results {
+		if r.Error == nil {
+			out = append(out, r.edge)
+		}
+	}
+
+	return out
+}
+
+// connectRecord is the machine readable form of a connectResult
+type connectRecord struct {
+	From      int          `json:"from"`
+	To        int          `json:"to"`
+	Attempts  int          `json:"attempts"`
+	LatencyMs float64      `json:"latency_ms"`
+	Error     *ErrorRecord `json:"error"`
+}
+
+// connectReport prints the latency of every pair to w, and a summary to errw
+func connectReport(w, errw io.Writer, results []connectResult) {
+	var succeeded, failed, retried int
+	for _, r := range results {
+		if r.Error != nil {
+			failed++
+		} else {
+			succeeded++
+		}
+
+		if r.Attempts > 1 {
+			retried++
+		}
+
+		if r.Attempts == 0 {
+			continue
+		}
+
+		status := "ok"
+		if r.Error != nil {
+			status = "failed"
+		}
+
+		fmt.Fprintf(w, "node[%d] => node[%d] %s %s (%d attempts)\n", r.From, r.To, status, r.Latency.Round(time.Millisecond), r.Attempts)
+	}
+
+	fmt.Fprintf(errw, "%d pairs: %d succeeded, %d failed, %d retried\n", len(results), succeeded, failed, retried)
+}
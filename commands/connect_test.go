@@ -0,0 +1,83 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	testbedi "github.com/ipfs/iptb/testbed/interfaces"
+)
+
+func TestConnectNodesRetries(t *testing.T) {
+	var lk sync.Mutex
+	attempts := make(map[int][]time.Time)
+
+	// node[0] connects on its third attempt, node[1] never does
+	tb := newTestTestbed(t, 3, func(index int) testbedi.Core {
+		return &testNode{index: index, connect: func(ctx context.Context, to testbedi.Core) error {
+			lk.Lock()
+			defer lk.Unlock()
+
+			attempts[index] = append(attempts[index], time.Now())
+			if index == 0 && len(attempts[index]) == 3 {
+				return nil
+			}
+
+			return fmt.Errorf("refused")
+		}}
+	})
+
+	backoff := 20 * time.Millisecond
+	results, err := connectNodes(&mapper{ctx: context.Background()}, tb, []edge{{0, 2}, {1, 2}}, connectOptions{
+		Retries: 3,
+		Backoff: backoff,
+	})
+	expect(t, err, nil)
+
+	expect(t, results[0].Attempts, 3)
+	expect(t, results[0].Error, nil)
+
+	expect(t, results[1].Attempts, 4)
+	expect(t, results[1].Error.Error(), "node[1] => node[2]: refused")
+
+	// The delay before every retry doubles
+	calls := attempts[1]
+	for i := 1; i < len(calls); i++ {
+		if gap, least := calls[i].Sub(calls[i-1]), backoff<<uint(i-1); gap < least {
+			t.Errorf("retry %d after %s, expected at least %s", i, gap, least)
+		}
+	}
+}
+
+func TestConnectNodesFailFast(t *testing.T) {
+	tb := newTestTestbed(t, 3, func(index int) testbedi.Core {
+		return &testNode{index: index, connect: func(ctx context.Context, to testbedi.Core) error {
+			return fmt.Errorf("refused")
+		}}
+	})
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	m := &mapper{ctx: ctx, cancel: cancel, sem: make(chan struct{}, 1)}
+	results, err := connectNodes(m, tb, []edge{{0, 1}, {1, 2}, {0, 1}}, connectOptions{})
+	expect(t, err, nil)
+
+	expect(t, len(results), 2)
+	expect(t, results[0].Attempts, 1)
+	expect(t, results[1].Attempts, 0)
+	expect(t, results[1].Error.Error(), "node[1] => node[2]: not started: cancelled after node[0] => node[1]: refused")
+}
+
+func TestConnectedEdges(t *testing.T) {
+	results := []connectResult{
+		{edge: edge{0, 1}, Attempts: 1},
+		{edge: edge{0, 2}, Attempts: 2, Error: fmt.Errorf("refused")},
+		{edge: edge{1, 2}, Error: fmt.Errorf("not started")},
+		{edge: edge{2, 0}, Attempts: 1},
+	}
+
+	expect(t, connectedEdges(results), []edge{{0, 1}, {2, 0}})
+}
@@ -0,0 +1,105 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	cli "github.com/urfave/cli"
+)
+
+// Causes of the cancellation of the root context
+var (
+	errInterrupted = errors.New("interrupted")
+	errTimedOut    = errors.New("timed out")
+)
+
+// NewRootContext returns the context every command runs under. It is
+// cancelled on SIGINT or SIGTERM, and once timeout elapsed when it is set.
+// After the first signal, the default behaviour is restored so a second one
+// terminates iptb immediately.
+func NewRootContext(timeout time.Duration) context.Context {
+	ctx, cancel := context.WithCancelCause(context.Background())
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		sig := <-sigs
+		signal.Stop(sigs)
+		cancel(fmt.Errorf("%w by %s", errInterrupted, sig))
+	}()
+
+	if timeout > 0 {
+		time.AfterFunc(timeout, func() {
+			cancel(fmt.Errorf("%w after %s", errTimedOut, timeout))
+		})
+	}
+
+	return ctx
+}
+
+// rootContext returns the context set up for the command by NewRootContext
+func rootContext(c *cli.Context) context.Context {
+	if ctx, ok := c.App.Metadata["context"].(context.Context); ok {
+		return ctx
+	}
+
+	return context.Background()
+}
+
+// ParseTimeout parses the value of a --timeout flag, where an empty value
+// means no timeout
+func ParseTimeout(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, NewUsageError(fmt.Sprintf("invalid timeout %s: %s", s, err))
+	}
+
+	return d, nil
+}
+
+// withTimeout derives a context which expires after timeout, unless it is zero
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeoutCause(ctx, timeout, fmt.Errorf("%w after %s", errTimedOut, timeout))
+}
+
+// Exit codes of iptb, besides 0 on success
+const (
+	ExitFailure     = 1
+	ExitUsage       = 2
+	ExitTimedOut    = 124
+	ExitInterrupted = 130
+)
+
+// ExitCode returns the exit code of iptb once a command returned err under
+// the root context ctx
+func ExitCode(ctx context.Context, err error) int {
+	if ctx != nil && ctx.Err() != nil {
+		switch cause := context.Cause(ctx); {
+		case errors.Is(cause, errInterrupted):
+			return ExitInterrupted
+		case errors.Is(cause, errTimedOut):
+			return ExitTimedOut
+		}
+	}
+
+	var ec cli.ExitCoder
+	if errors.As(err, &ec) {
+		return ec.ExitCode()
+	}
+
+	return ExitFailure
+}
@@ -0,0 +1,128 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	cli "github.com/urfave/cli"
+
+	testbedi "github.com/ipfs/iptb/testbed/interfaces"
+)
+
+func TestParseTimeout(t *testing.T) {
+	d, err := ParseTimeout("")
+	expect(t, err, nil)
+	expect(t, d, time.Duration(0))
+
+	d, err = ParseTimeout("1m30s")
+	expect(t, err, nil)
+	expect(t, d, 90*time.Second)
+
+	_, err = ParseTimeout("soon")
+	var usage *UsageError
+	if !errors.As(err, &usage) {
+		t.Errorf("expected a usage error, got %v", err)
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	ctx, cancel := withTimeout(context.Background(), 0)
+	defer cancel()
+
+	_, ok := ctx.Deadline()
+	expect(t, ok, false)
+
+	ctx, cancel = withTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+
+	<-ctx.Done()
+	if cause := context.Cause(ctx); !errors.Is(cause, errTimedOut) {
+		t.Errorf("expected a timeout, got %v", cause)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	cancelled := func(cause error) context.Context {
+		ctx, cancel := context.WithCancelCause(context.Background())
+		cancel(cause)
+		return ctx
+	}
+
+	cases := []struct {
+		ctx      context.Context
+		err      error
+		expected int
+	}{
+		{context.Background(), fmt.Errorf("failed"), ExitFailure},
+		{context.Background(), NewUsageError("bad flag"), ExitUsage},
+		{context.Background(), cli.NewExitError("exit", 3), 3},
+		{nil, fmt.Errorf("failed"), ExitFailure},
+		{cancelled(fmt.Errorf("%w by interrupt", errInterrupted)), fmt.Errorf("failed"), ExitInterrupted},
+		{cancelled(fmt.Errorf("%w after 1s", errTimedOut)), fmt.Errorf("failed"), ExitTimedOut},
+		{cancelled(fmt.Errorf("other")), fmt.Errorf("failed"), ExitFailure},
+	}
+
+	for _, c := range cases {
+		expect(t, ExitCode(c.ctx, c.err), c.expected)
+	}
+}
+
+// notifyWriter signals every write on written
+type notifyWriter struct {
+	bytes.Buffer
+	written chan struct{}
+}
+
+func (w *notifyWriter) Write(p []byte) (int, error) {
+	defer close(w.written)
+	return w.Buffer.Write(p)
+}
+
+func TestMapWithOutputCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+
+	w := &notifyWriter{written: make(chan struct{})}
+	m := &mapper{ctx: ctx, sem: make(chan struct{}, 1), w: w}
+
+	started := make(chan struct{})
+	go func() {
+		<-started
+		cancel(fmt.Errorf("%w by interrupt", errInterrupted))
+	}()
+
+	// node[0] holds the only slot until the pending nodes are reported,
+	// node[1] never starts
+	results, err := m.mapWithOutput([]int{0, 1}, newTestNodes(2, nil), func(ctx context.Context, n int, node testbedi.Core) (testbedi.Output, error) {
+		close(started)
+		<-ctx.Done()
+
+		select {
+		case <-w.written:
+		case <-time.After(5 * time.Second):
+		}
+
+		return nil, ctx.Err()
+	})
+	expect(t, err, nil)
+
+	expect(t, results[0].Error.Error(), "node[0]: context canceled")
+	expect(t, results[1].Error.Error(), "node[1]: not started: interrupted by interrupt")
+	expect(t, w.String(), "interrupted by interrupt, still pending: node[0] node[1]\n")
+}
+
+func TestMapWithOutputTimeout(t *testing.T) {
+	m := &mapper{ctx: context.Background(), timeout: 10 * time.Millisecond}
+
+	// Commands killed by the timeout fail even when they only exited
+	results, err := m.mapWithOutput([]int{0}, newTestNodes(1, nil), func(ctx context.Context, n int, node testbedi.Core) (testbedi.Output, error) {
+		<-ctx.Done()
+		return testOutput(nil, "", -1), nil
+	})
+	expect(t, err, nil)
+
+	expect(t, results[0].Error.Error(), "node[0]: timed out after 10ms")
+}
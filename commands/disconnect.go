@@ -0,0 +1,130 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	cli "github.com/urfave/cli"
+
+	"github.com/ipfs/iptb/testbed"
+	testbedi "github.com/ipfs/iptb/testbed/interfaces"
+	"github.com/ipfs/iptb/testbed/netns"
+)
+
+var DisconnectCmd = cli.Command{
+	Category:  "CORE",
+	Name:      "disconnect",
+	Usage:     "disconnect sets of nodes from each other (or all)",
+	ArgsUsage: "[nodes] [nodes]",
+	Description: `
+The disconnect command is the inverse of connect, every node listed in the
+first set closes its connections to every node listed in the second set.
+
+It accepts the same arguments as connect:
+
+$ iptb disconnect             => iptb disconnect [0-C] [0-C]
+$ iptb disconnect [n-m]       => iptb disconnect [n-m] [n-m]
+$ iptb disconnect [n-m] [i-k]
+
+Nodes must implement disconnect for this command to work.
+`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "timeout",
+			Usage: "timeout on the command",
+			Value: "30s",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		flagRoot := c.GlobalString("IPTB_ROOT")
+		flagTestbed := c.GlobalString("testbed")
+		flagQuiet := c.GlobalBool("quiet")
+		flagFormat := c.GlobalString("format")
+		flagAllowFailures := c.GlobalInt("allow-failures")
+
+		tb := testbed.NewTestbed(path.Join(flagRoot, "testbeds", flagTestbed))
+		args := c.Args()
+
+		nodes, err := tb.Nodes()
+		if err != nil {
+			return err
+		}
+
+		var from, to []int
+		switch c.NArg() {
+		case 0:
+			from, err = parseRange(fmt.Sprintf("[0-%d]", len(nodes)-1))
+			to = from
+		case 1:
+			from, err = parseRange(args[0])
+			to = from
+		case 2:
+			from, err = parseRange(args[0])
+			if err == nil {
+				to, err = parseRange(args[1])
+			}
+		default:
+			return NewUsageError("disconnect accepts between 0 and 2 arguments")
+		}
+		if err != nil {
+			return err
+		}
+
+		nw, err := netns.Load(tb.Dir())
+		if err != nil {
+			return err
+		}
+
+		edges := bipartite(from, to)
+		for _, e := range edges {
+			if err := validRange([]int{e.From, e.To}, len(nodes)); err != nil {
+				return err
+			}
+		}
+
+		pairs := make([][2]int, len(edges))
+		for i, e := range edges {
+			pairs[i] = [2]int{e.From, e.To}
+		}
+
+		m, err := newMapper(c)
+		if err != nil {
+			return err
+		}
+
+		results := m.mapPairs(pairs, "=/>", func(ctx context.Context, from, to int) error {
+			return disconnectNodes(ctx, nw, nodes, from, to)
+		})
+
+		// Only the pairs which disconnected leave the requested topology
+		var disconnected []edge
+		for i, rs := range results {
+			if rs.Error == nil {
+				disconnected = append(disconnected, edges[i])
+			}
+		}
+
+		if err := recordTopology(tb, disconnected, false); err != nil {
+			return err
+		}
+
+		return buildReport(results, flagQuiet, flagFormat, flagAllowFailures)
+	},
+}
+
+// errNoDisconnect is returned when the plugin of a node can not disconnect
+var errNoDisconnect = fmt.Errorf("node does not implement disconnect")
+
+// disconnectNodes closes the connections of node `from` to node `to`, within
+// the deadline of ctx
+func disconnectNodes(ctx context.Context, nw *netns.Network, nodes []testbedi.Core, from, to int) error {
+	dn, ok := nodes[from].(testbedi.Disconnector)
+	if !ok {
+		return fmt.Errorf("%w (plugin %s)", errNoDisconnect, nodes[from].Type())
+	}
+
+	return execNetns(nw, nodes[from].Dir(), func() error {
+		return dn.Disconnect(ctx, nodes[to])
+	})
+}
@@ -1,10 +1,16 @@
 package commands
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
 	"fmt"
-	"io"
+	"os"
 	"path"
-	"strconv"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
 
 	cli "github.com/urfave/cli"
 
@@ -16,38 +22,271 @@ var EventsCmd = cli.Command{
 	Category:  "METRICS",
 	Name:      "events",
 	Usage:     "stream events from specified nodes (or all)",
-	ArgsUsage: "[node]",
+	ArgsUsage: "[nodes]",
+	Description: `
+The events command streams the events of every node at once, until the
+streams end or iptb is interrupted. Every event is printed on its own line,
+with the time it was received and the node it came from:
+
+$ iptb events --type bootstrap [0-3]
+14:02:11.207 [node 2] {"type":"bootstrap","peers":4}
+
+The type of an event is its "type" or "event" field, when it is a json object.
+Events can be filtered by type with --type, and with --match, either a regular
+expression or a json path=value, e.g. '.peers=4'. A stream which is lost is
+reported, while the others go on.
+
+With --out, the events printed are also written to a file as ndjson, for later
+analysis. A single node, e.g. 'iptb events 0', prints its events alone, as
+they were received.
+`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "type",
+			Usage: "comma separated types of the events to print",
+		},
+		cli.StringFlag{
+			Name:  "match",
+			Usage: "regex or json path=value events must match to be printed",
+		},
+		cli.StringFlag{
+			Name:  "out",
+			Usage: "file the events printed are also written to, as ndjson",
+		},
+	},
 	Action: func(c *cli.Context) error {
 		flagRoot := c.GlobalString("IPTB_ROOT")
 		flagTestbed := c.GlobalString("testbed")
+		flagQuiet := c.GlobalBool("quiet")
+		flagFormat := c.GlobalString("format")
+		flagAllowFailures := c.GlobalInt("allow-failures")
+		flagOut := c.String("out")
 
-		if !c.Args().Present() {
-			return NewUsageError("events takes exactly 1 argument")
+		if flagFormat == formatJSON {
+			return NewUsageError("events can not be used with --format json, use ndjson")
 		}
 
-		i, err := strconv.Atoi(c.Args().First())
+		filter, err := newEventFilter(c.String("type"), c.String("match"))
 		if err != nil {
-			return fmt.Errorf("parse err: %s", err)
+			return err
 		}
 
 		tb := testbed.NewTestbed(path.Join(flagRoot, "testbeds", flagTestbed))
-
-		node, err := tb.Node(i)
+		nodes, err := tb.Nodes()
 		if err != nil {
 			return err
 		}
 
-		mn, ok := node.(testbedi.Metric)
-		if !ok {
-			return fmt.Errorf("node does not implement metrics")
+		nodeRange := c.Args().First()
+
+		if nodeRange == "" {
+			nodeRange = fmt.Sprintf("[0-%d]", len(nodes)-1)
 		}
 
-		el, err := mn.Events()
+		list, err := parseRange(nodeRange)
 		if err != nil {
+			return fmt.Errorf("could not parse node range %s", nodeRange)
+		}
+
+		if err := validRange(list, len(nodes)); err != nil {
 			return err
 		}
 
-		_, err = io.Copy(c.App.Writer, el)
-		return err
+		var out *json.Encoder
+		if flagOut != "" {
+			fi, err := os.Create(flagOut)
+			if err != nil {
+				return err
+			}
+
+			defer fi.Close()
+			out = json.NewEncoder(fi)
+		}
+
+		single := len(list) == 1 && !strings.HasPrefix(nodeRange, "[")
+
+		var lk sync.Mutex
+		emit := func(ev nodeEvent) bool {
+			if !filter.match(ev) {
+				return true
+			}
+
+			lk.Lock()
+			defer lk.Unlock()
+
+			if out != nil {
+				out.Encode(ev)
+			}
+
+			switch {
+			case flagFormat == formatNDJSON:
+				json.NewEncoder(c.App.Writer).Encode(ev)
+			case single:
+				fmt.Fprintf(c.App.Writer, "%s\n", ev.Line)
+			default:
+				fmt.Fprintf(c.App.Writer, "%s [node %d] %s\n", ev.Time.Format("15:04:05.000"), ev.Node, ev.Line)
+			}
+
+			return true
+		}
+
+		lost := func(n int, err error) {
+			if !flagQuiet {
+				fmt.Fprintf(c.App.ErrWriter, "node[%d]: event stream lost: %s\n", n, err)
+			}
+		}
+
+		results := streamEvents(rootContext(c), list, nodes, emit, lost)
+
+		return checkFailures(results, flagAllowFailures)
 	},
 }
+
+// nodeEvent is a line of the event stream of a node
+type nodeEvent struct {
+	Node int       `json:"node"`
+	Time time.Time `json:"time"`
+	Type string    `json:"type,omitempty"`
+	Line string    `json:"line"`
+}
+
+func newNodeEvent(n int, t time.Time, line string) nodeEvent {
+	ev := nodeEvent{Node: n, Time: t, Line: line}
+
+	var obj map[string]interface{}
+	if json.Unmarshal([]byte(line), &obj) == nil {
+		for _, key := range []string{"type", "event"} {
+			if typ, ok := obj[key].(string); ok {
+				ev.Type = typ
+				break
+			}
+		}
+	}
+
+	return ev
+}
+
+// eventFilter selects events by type, and by a regular expression or the
+// value at a json path
+type eventFilter struct {
+	types map[string]bool
+	re    *regexp.Regexp
+	json  *jsonExpectation
+}
+
+func newEventFilter(types, match string) (eventFilter, error) {
+	var f eventFilter
+
+	if types != "" {
+		f.types = make(map[string]bool)
+		for _, typ := range strings.Split(types, ",") {
+			f.types[strings.TrimSpace(typ)] = true
+		}
+	}
+
+	if strings.HasPrefix(match, ".") {
+		if je, err := parseJSONExpectation(match); err == nil {
+			f.json = &je
+			return f, nil
+		}
+	}
+
+	if match != "" {
+		re, err := regexp.Compile(match)
+		if err != nil {
+			return f, NewUsageError(fmt.Sprintf("invalid match %s: %s", match, err))
+		}
+
+		f.re = re
+	}
+
+	return f, nil
+}
+
+func (f eventFilter) match(ev nodeEvent) bool {
+	if f.types != nil && !f.types[ev.Type] {
+		return false
+	}
+
+	if f.json != nil {
+		var doc interface{}
+		if err := json.Unmarshal([]byte(ev.Line), &doc); err != nil {
+			return false
+		}
+
+		return f.json.check(doc) == nil
+	}
+
+	return f.re == nil || f.re.MatchString(ev.Line)
+}
+
+// streamEvents reads the event streams of every node of list at once, and
+// calls emit with every event, until the streams end or ctx is done. The
+// stream of a node is closed once emit returns false for one of its events.
+// Streams which fail are passed to lost as they fail, and their errors are
+// set on the results. Streams stay open, so they are not bounded by the
+// global --concurrency.
+func streamEvents(ctx context.Context, list []int, nodes []testbedi.Core, emit func(nodeEvent) bool, lost func(int, error)) []Result {
+	var wg sync.WaitGroup
+	results := make([]Result, len(list))
+
+	for i, n := range list {
+		wg.Add(1)
+		go func(i, n int, node testbedi.Core) {
+			defer wg.Done()
+
+			start := time.Now()
+			err := streamNode(ctx, n, node, emit)
+			if err != nil {
+				lost(n, err)
+				err = fmt.Errorf("node[%d]: %w", n, err)
+			}
+
+			results[i] = Result{Node: n, Error: err, Duration: time.Since(start)}
+		}(i, n, nodes[n])
+	}
+
+	wg.Wait()
+
+	return results
+}
+
+func streamNode(ctx context.Context, n int, node testbedi.Core, emit func(nodeEvent) bool) error {
+	metricNode, ok := node.(testbedi.Metric)
+	if !ok {
+		return fmt.Errorf("node does not implement metrics")
+	}
+
+	events, err := metricNode.Events()
+	if err != nil {
+		return err
+	}
+
+	// Reads can not be cancelled, the stream is closed instead
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+
+		events.Close()
+	}()
+
+	scanner := bufio.NewScanner(events)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if !emit(newNodeEvent(n, time.Now(), scanner.Text())) {
+			return nil
+		}
+	}
+
+	// Reads fail once the stream is closed on interruption
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,38 @@
+package commands
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEventFilter(t *testing.T) {
+	now := time.Now()
+
+	expect(t, newNodeEvent(0, now, `{"type":"bootstrap"}`).Type, "bootstrap")
+	expect(t, newNodeEvent(0, now, `{"event":"dial","type":3}`).Type, "dial")
+	expect(t, newNodeEvent(0, now, `not json`).Type, "")
+
+	f, err := newEventFilter("bootstrap, dial", `peers":[1-9]`)
+	expect(t, err, nil)
+
+	expect(t, f.match(newNodeEvent(0, now, `{"type":"bootstrap","peers":4}`)), true)
+	expect(t, f.match(newNodeEvent(0, now, `{"type":"bootstrap","peers":0}`)), false)
+	expect(t, f.match(newNodeEvent(0, now, `{"type":"tick","peers":4}`)), false)
+
+	f, err = newEventFilter("", "")
+	expect(t, err, nil)
+	expect(t, f.match(newNodeEvent(0, now, `anything`)), true)
+
+	f, err = newEventFilter("", `.peers=4`)
+	expect(t, err, nil)
+	expect(t, f.match(newNodeEvent(0, now, `{"type":"bootstrap","peers":4}`)), true)
+	expect(t, f.match(newNodeEvent(0, now, `{"type":"bootstrap","peers":40}`)), false)
+	expect(t, f.match(newNodeEvent(0, now, `peers=4`)), false)
+
+	f, err = newEventFilter("", `.*peers`)
+	expect(t, err, nil)
+	expect(t, f.match(newNodeEvent(0, now, `{"peers":4}`)), true)
+
+	_, err = newEventFilter("", "(")
+	expect(t, err != nil, true)
+}
@@ -0,0 +1,257 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	testbedi "github.com/ipfs/iptb/testbed/interfaces"
+)
+
+// expectation is what the output of a command must look like on every node
+type expectation struct {
+	// Exit is the expected exit code, which is not checked when nil
+	Exit *int
+	// AnyExit accepts any exit code, e.g. when only stdout matters
+	AnyExit     bool
+	Stdout      *regexp.Regexp
+	StderrEmpty bool
+	JSON        []jsonExpectation
+}
+
+// check reads the output of a command and returns an error naming every
+// expectation it broke. The output returned replaces out, which can not be
+// read twice.
+func (e *expectation) check(out testbedi.Output) (testbedi.Output, error) {
+	if out == nil {
+		return out, fmt.Errorf("no output")
+	}
+
+	stdout, _ := io.ReadAll(out.Stdout())
+	stderr, _ := io.ReadAll(out.Stderr())
+	captured := &capturedOutput{Output: out, stdout: stdout, stderr: stderr}
+
+	var broken []string
+
+	if e.Exit != nil && out.ExitCode() != *e.Exit {
+		broken = append(broken, fmt.Sprintf("exit %d, expected %d", out.ExitCode(), *e.Exit))
+	}
+
+	if e.Stdout != nil && !e.Stdout.Match(stdout) {
+		broken = append(broken, fmt.Sprintf("stdout does not match %q: %s", strings.TrimPrefix(e.Stdout.String(), "(?m)"), excerpt(stdout)))
+	}
+
+	if e.StderrEmpty && len(bytes.TrimSpace(stderr)) != 0 {
+		broken = append(broken, fmt.Sprintf("stderr is not empty: %s", excerpt(stderr)))
+	}
+
+	if len(e.JSON) != 0 {
+		var doc interface{}
+		if err := json.Unmarshal(stdout, &doc); err != nil {
+			broken = append(broken, fmt.Sprintf("stdout is not json: %s", excerpt(stdout)))
+		} else {
+			for _, je := range e.JSON {
+				if err := je.check(doc); err != nil {
+					broken = append(broken, err.Error())
+				}
+			}
+		}
+	}
+
+	if len(broken) != 0 {
+		return captured, fmt.Errorf("%s", strings.Join(broken, "; "))
+	}
+
+	// A non-zero exit code is only a failure when it was not expected
+	captured.expected = e.Exit != nil || e.AnyExit
+	return captured, nil
+}
+
+// compileOutputRegexp compiles a regex matched against output, in which ^ and
+// $ match at the start and end of every line, like grep
+func compileOutputRegexp(s string) (*regexp.Regexp, error) {
+	return regexp.Compile("(?m)" + s)
+}
+
+// checkSameOutput fails every result whose stdout differs from the stdout
+// printed by most nodes. Results must hold outputs returned by check.
+func checkSameOutput(results []Result) {
+	counts := make(map[string]int)
+	first := make(map[string]int)
+	for _, rs := range results {
+		out, ok := rs.Output.(*capturedOutput)
+		if rs.Error != nil || !ok {
+			continue
+		}
+
+		s := string(out.stdout)
+		if _, ok := first[s]; !ok {
+			first[s] = rs.Node
+		}
+		counts[s]++
+	}
+
+	var common string
+	for s, count := range counts {
+		if count > counts[common] || (count == counts[common] && first[s] < first[common]) {
+			common = s
+		}
+	}
+
+	for i, rs := range results {
+		out, ok := rs.Output.(*capturedOutput)
+		if rs.Error != nil || !ok || string(out.stdout) == common {
+			continue
+		}
+
+		results[i].Error = fmt.Errorf("node[%d]: stdout differs from node[%d]: %s", rs.Node, first[common], excerpt(out.stdout))
+	}
+}
+
+// jsonExpectation checks the value at a path of a json document, e.g.
+// .Addresses[0]="/ip4/127.0.0.1/tcp/4001"
+type jsonExpectation struct {
+	Path  string
+	path  []interface{}
+	Value interface{}
+}
+
+// parseJSONExpectation parses path=value. The value is read as json, or as a
+// string when it is not valid json.
+func parseJSONExpectation(s string) (jsonExpectation, error) {
+	p, value, ok := strings.Cut(s, "=")
+	if !ok {
+		return jsonExpectation{}, fmt.Errorf("json expectation %q is not of the form path=value", s)
+	}
+
+	path, err := parseJSONPath(p)
+	if err != nil {
+		return jsonExpectation{}, err
+	}
+
+	je := jsonExpectation{Path: p, path: path, Value: value}
+	if err := json.Unmarshal([]byte(value), &je.Value); err != nil {
+		je.Value = value
+	}
+
+	return je, nil
+}
+
+// parseJSONPath parses a path of keys and indexes, e.g. .a.b[0], into a list
+// of strings and ints
+func parseJSONPath(s string) ([]interface{}, error) {
+	if !strings.HasPrefix(s, ".") {
+		return nil, fmt.Errorf("json path %q must start with '.'", s)
+	}
+
+	var path []interface{}
+	for _, part := range strings.Split(s[1:], ".") {
+		key, rest, indexed := strings.Cut(part, "[")
+		if key != "" {
+			path = append(path, key)
+		}
+
+		for indexed {
+			index, tail, ok := strings.Cut(rest, "]")
+			if !ok {
+				return nil, fmt.Errorf("json path %q has an unclosed '['", s)
+			}
+
+			i, err := strconv.Atoi(index)
+			if err != nil {
+				return nil, fmt.Errorf("json path %q has an invalid index %q", s, index)
+			}
+
+			path = append(path, i)
+			rest, indexed = strings.CutPrefix(tail, "[")
+			if !indexed && rest != "" {
+				return nil, fmt.Errorf("json path %q has %q after an index", s, rest)
+			}
+		}
+	}
+
+	return path, nil
+}
+
+func (je jsonExpectation) check(doc interface{}) error {
+	for _, elem := range je.path {
+		switch elem := elem.(type) {
+		case string:
+			obj, ok := doc.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("json %s is missing", je.Path)
+			}
+
+			if doc, ok = obj[elem]; !ok {
+				return fmt.Errorf("json %s is missing", je.Path)
+			}
+		case int:
+			list, ok := doc.([]interface{})
+			if !ok || elem < 0 || elem >= len(list) {
+				return fmt.Errorf("json %s is missing", je.Path)
+			}
+
+			doc = list[elem]
+		}
+	}
+
+	if !reflect.DeepEqual(doc, je.Value) {
+		got, _ := json.Marshal(doc)
+		want, _ := json.Marshal(je.Value)
+		return fmt.Errorf("json %s is %s, expected %s", je.Path, shorten(string(got)), want)
+	}
+
+	return nil
+}
+
+// capturedOutput is an Output whose stdout and stderr were already read
+type capturedOutput struct {
+	testbedi.Output
+	stdout []byte
+	stderr []byte
+	// expected is set when the exit code met an expectation, so that a
+	// non-zero exit code is not reported as a failure
+	expected bool
+}
+
+func (o *capturedOutput) Stdout() io.ReadCloser {
+	return io.NopCloser(bytes.NewReader(o.stdout))
+}
+
+func (o *capturedOutput) Stderr() io.ReadCloser {
+	return io.NopCloser(bytes.NewReader(o.stderr))
+}
+
+// exitFailed reports whether out exited with a non-zero code which was not
+// expected
+func exitFailed(out testbedi.Output) bool {
+	if out == nil || out.ExitCode() == 0 {
+		return false
+	}
+
+	if c, ok := out.(*capturedOutput); ok && c.expected {
+		return false
+	}
+
+	return true
+}
+
+// excerpt shortens output to be quoted in an error
+func excerpt(data []byte) string {
+	return strconv.Quote(shorten(strings.TrimSpace(string(data))))
+}
+
+func shorten(s string) string {
+	const max = 200
+
+	if len(s) > max {
+		return s[:max] + "..."
+	}
+
+	return s
+}
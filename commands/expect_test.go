@@ -0,0 +1,67 @@
+package commands
+
+import (
+	"testing"
+
+	iptbutil "github.com/ipfs/iptb/util"
+)
+
+func TestParseJSONPath(t *testing.T) {
+	path, err := parseJSONPath(".a.b[1][0].c")
+
+	expect(t, err, nil)
+	expect(t, path, []interface{}{"a", "b", 1, 0, "c"})
+
+	path, err = parseJSONPath(".")
+
+	expect(t, err, nil)
+	expect(t, len(path), 0)
+
+	for _, bad := range []string{"a", ".a[", ".a[x]"} {
+		if _, err := parseJSONPath(bad); err == nil {
+			t.Fatalf("expected an error for %q", bad)
+		}
+	}
+}
+
+func TestExpectationCheck(t *testing.T) {
+	re, err := compileOutputRegexp("^ok$")
+	expect(t, err, nil)
+
+	je, err := parseJSONExpectation(`.list[1]="b"`)
+	expect(t, err, nil)
+
+	exit := 3
+	e := &expectation{Exit: &exit, Stdout: re, StderrEmpty: true}
+
+	out, err := e.check(iptbutil.NewOutput(nil, []byte("ok\n"), nil, 3, nil))
+	expect(t, err, nil)
+	expect(t, exitFailed(out), false)
+
+	_, err = e.check(iptbutil.NewOutput(nil, []byte("ko\n"), []byte("warn"), 0, nil))
+	expect(t, err.Error(), `exit 0, expected 3; stdout does not match "^ok$": "ko"; stderr is not empty: "warn"`)
+
+	e = &expectation{JSON: []jsonExpectation{je}}
+
+	_, err = e.check(iptbutil.NewOutput(nil, []byte(`{"list":["a","b"]}`), nil, 0, nil))
+	expect(t, err, nil)
+
+	_, err = e.check(iptbutil.NewOutput(nil, []byte(`{"list":["a","c"]}`), nil, 0, nil))
+	expect(t, err.Error(), `json .list[1] is "c", expected "b"`)
+}
+
+func TestCheckSameOutput(t *testing.T) {
+	e := &expectation{}
+
+	var results []Result
+	for n, stdout := range []string{"b", "a", "a"} {
+		out, _ := e.check(iptbutil.NewOutput(nil, []byte(stdout), nil, 0, nil))
+		results = append(results, Result{Node: n, Output: out})
+	}
+
+	checkSameOutput(results)
+
+	expect(t, results[0].Error.Error(), `node[0]: stdout differs from node[1]: "b"`)
+	expect(t, results[1].Error, nil)
+	expect(t, results[2].Error, nil)
+}
@@ -0,0 +1,159 @@
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"time"
+
+	cli "github.com/urfave/cli"
+)
+
+// Formats accepted by the global --format flag
+const (
+	formatText   = "text"
+	formatJSON   = "json"
+	formatNDJSON = "ndjson"
+)
+
+// ValidateFormat checks the value of the global --format flag
+func ValidateFormat(format string) error {
+	switch format {
+	case formatText, formatJSON, formatNDJSON:
+		return nil
+	}
+
+	return NewUsageError(fmt.Sprintf("unknown format %s, expected text, json or ndjson", format))
+}
+
+// ErrorRecord is the machine readable form of an error. Errors aggregated
+// from many nodes are listed under Errors.
+type ErrorRecord struct {
+	Message string        `json:"message"`
+	Errors  []ErrorRecord `json:"errors,omitempty"`
+}
+
+// NewErrorRecord builds the machine readable form of err
+func NewErrorRecord(err error) *ErrorRecord {
+	if err == nil {
+		return nil
+	}
+
+	rec := &ErrorRecord{
+		Message: err.Error(),
+	}
+
+	var merr cli.MultiError
+	if errors.As(err, &merr) {
+		for _, e := range merr.Errors {
+			rec.Errors = append(rec.Errors, *NewErrorRecord(e))
+		}
+	}
+
+	return rec
+}
+
+// WriteError prints err to w, as a json object when format is json or ndjson
+func WriteError(w io.Writer, format string, err error) {
+	if format == formatJSON || format == formatNDJSON {
+		json.NewEncoder(w).Encode(struct {
+			Error *ErrorRecord `json:"error"`
+		}{NewErrorRecord(err)})
+		return
+	}
+
+	fmt.Fprintf(w, "%s\n", err)
+}
+
+// valueRecord is the machine readable form of a single attribute or metric
+type valueRecord struct {
+	Node  int    `json:"node"`
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// descRecord is the machine readable form of an attribute or metric listing
+type descRecord struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// resultRecord is the machine readable form of a Result
+type resultRecord struct {
+	Node       int          `json:"node"`
+	Args       []string     `json:"args"`
+	ExitCode   int          `json:"exit_code"`
+	Error      *ErrorRecord `json:"error"`
+	Stdout     string       `json:"stdout"`
+	Stderr     string       `json:"stderr"`
+	DurationMs float64      `json:"duration_ms"`
+	ReadyMs    float64      `json:"ready_ms,omitempty"`
+}
+
+func newResultRecord(rs Result) resultRecord {
+	rec := resultRecord{
+		Node:       rs.Node,
+		Args:       []string{},
+		Error:      NewErrorRecord(rs.Error),
+		DurationMs: durationMs(rs.Duration),
+		ReadyMs:    durationMs(rs.Ready),
+	}
+
+	if rs.Output != nil {
+		if args := rs.Output.Args(); args != nil {
+			rec.Args = args
+		}
+
+		rec.ExitCode = rs.Output.ExitCode()
+
+		if rec.Error == nil {
+			rec.Error = NewErrorRecord(rs.Output.Error())
+		}
+
+		if stdout := rs.Output.Stdout(); stdout != nil {
+			data, _ := io.ReadAll(stdout)
+			rec.Stdout = string(data)
+		}
+
+		if stderr := rs.Output.Stderr(); stderr != nil {
+			data, _ := io.ReadAll(stderr)
+			rec.Stderr = string(data)
+		}
+	}
+
+	return rec
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// writeFormatted prints v as json, as one json object per line for ndjson when
+// v is a slice, or calls text for the text format
+func writeFormatted(w io.Writer, format string, v interface{}, text func(io.Writer) error) error {
+	switch format {
+	case formatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case formatNDJSON:
+		enc := json.NewEncoder(w)
+
+		rv := reflect.ValueOf(v)
+		if rv.Kind() != reflect.Slice {
+			return enc.Encode(v)
+		}
+
+		for i := 0; i < rv.Len(); i++ {
+			if err := enc.Encode(rv.Index(i).Interface()); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	default:
+		return text(w)
+	}
+}
@@ -0,0 +1,31 @@
+package commands
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	cli "github.com/urfave/cli"
+)
+
+func TestWriteFormatted(t *testing.T) {
+	recs := []valueRecord{
+		{Node: 0, Name: "a", Value: "1"},
+		{Node: 1, Name: "a", Value: "2"},
+	}
+
+	var buf bytes.Buffer
+	err := writeFormatted(&buf, formatNDJSON, recs, nil)
+
+	expect(t, err, nil)
+	expect(t, buf.String(), "{\"node\":0,\"name\":\"a\",\"value\":\"1\"}\n{\"node\":1,\"name\":\"a\",\"value\":\"2\"}\n")
+}
+
+func TestNewErrorRecord(t *testing.T) {
+	err := cli.NewMultiError(fmt.Errorf("node[0]: a"), fmt.Errorf("node[1]: b"))
+
+	rec := NewErrorRecord(err)
+
+	expect(t, rec.Message, "node[0]: a\nnode[1]: b")
+	expect(t, rec.Errors, []ErrorRecord{{Message: "node[0]: a"}, {Message: "node[1]: b"}})
+}
@@ -0,0 +1,341 @@
+package commands
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// edge is a connection made from one node to another
+type edge struct {
+	From int
+	To   int
+}
+
+// graph collects edges between positions [0-n), ignoring duplicates and self
+// loops. Undirected edges are stored from the lower to the higher position.
+type graph struct {
+	n     int
+	edges []edge
+	seen  map[edge]bool
+	deg   []int
+}
+
+func newGraph(n int) *graph {
+	return &graph{
+		n:    n,
+		seen: make(map[edge]bool),
+		deg:  make([]int, n),
+	}
+}
+
+func (g *graph) has(a, b int) bool {
+	if a > b {
+		a, b = b, a
+	}
+
+	return g.seen[edge{a, b}]
+}
+
+func (g *graph) add(a, b int) bool {
+	if a == b || g.has(a, b) {
+		return false
+	}
+
+	if a > b {
+		a, b = b, a
+	}
+
+	e := edge{a, b}
+	g.seen[e] = true
+	g.edges = append(g.edges, e)
+	g.deg[a]++
+	g.deg[b]++
+
+	return true
+}
+
+func (g *graph) remove(a, b int) {
+	if a > b {
+		a, b = b, a
+	}
+
+	e := edge{a, b}
+	if !g.seen[e] {
+		return
+	}
+
+	delete(g.seen, e)
+	g.deg[a]--
+	g.deg[b]--
+
+	for i, o := range g.edges {
+		if o == e {
+			g.edges = append(g.edges[:i], g.edges[i+1:]...)
+			break
+		}
+	}
+}
+
+// bipartite returns an edge from every node in `from` to every node in `to`
+func bipartite(from, to []int) []edge {
+	var out []edge
+	for _, f := range from {
+		for _, t := range to {
+			if f == t {
+				continue
+			}
+
+			out = append(out, edge{f, t})
+		}
+	}
+
+	return out
+}
+
+// buildTopology generates the topology described by `spec` over the nodes in
+// list. Random topologies draw from rng.
+func buildTopology(spec string, list []int, rng *rand.Rand) ([]edge, error) {
+	name, params, _ := strings.Cut(spec, ":")
+	n := len(list)
+	g := newGraph(n)
+
+	switch name {
+	case "line":
+		for i := 0; i+1 < n; i++ {
+			g.add(i, i+1)
+		}
+	case "ring":
+		for i := 0; i+1 < n; i++ {
+			g.add(i, i+1)
+		}
+		if n > 2 {
+			g.add(n-1, 0)
+		}
+	case "star":
+		hub := 0
+		if params != "" {
+			node, err := strconv.Atoi(params)
+			if err != nil {
+				return nil, fmt.Errorf("star: could not parse hub %s", params)
+			}
+
+			hub = -1
+			for i, n := range list {
+				if n == node {
+					hub = i
+				}
+			}
+
+			if hub == -1 {
+				return nil, fmt.Errorf("star: hub %d is not in the node range", node)
+			}
+		}
+
+		for i := 0; i < n; i++ {
+			g.add(hub, i)
+		}
+	case "tree":
+		fanout, err := topologyInt(name, params, 1)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := 1; i < n; i++ {
+			g.add((i-1)/fanout, i)
+		}
+	case "random":
+		degree, err := topologyInt(name, params, 1)
+		if err != nil {
+			return nil, err
+		}
+
+		if degree >= n {
+			return nil, fmt.Errorf("random: degree %d requires more than %d nodes", degree, n)
+		}
+
+		// Every node is connected to random peers until it has at least
+		// `degree` neighbours
+		for i := 0; i < n; i++ {
+			for _, j := range rng.Perm(n) {
+				if g.deg[i] >= degree {
+					break
+				}
+
+				g.add(i, j)
+			}
+		}
+	case "erdos-renyi":
+		p, err := strconv.ParseFloat(params, 64)
+		if err != nil || p < 0 || p > 1 {
+			return nil, fmt.Errorf("erdos-renyi: expected a probability between 0 and 1, got %q", params)
+		}
+
+		for i := 0; i < n; i++ {
+			for j := i + 1; j < n; j++ {
+				if rng.Float64() < p {
+					g.add(i, j)
+				}
+			}
+		}
+	case "small-world":
+		parts := strings.Split(params, ",")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("small-world: expected <k>,<beta>, got %q", params)
+		}
+
+		k, err := topologyInt(name, parts[0], 2)
+		if err != nil {
+			return nil, err
+		}
+
+		beta, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || beta < 0 || beta > 1 {
+			return nil, fmt.Errorf("small-world: expected beta between 0 and 1, got %q", parts[1])
+		}
+
+		if k >= n {
+			return nil, fmt.Errorf("small-world: k %d requires more than %d nodes", k, n)
+		}
+
+		// Watts-Strogatz: a ring lattice where every node is connected to its
+		// k nearest neighbours, then each edge is rewired with probability beta
+		for i := 0; i < n; i++ {
+			for j := 1; j <= k/2; j++ {
+				g.add(i, (i+j)%n)
+			}
+		}
+
+		for j := 1; j <= k/2; j++ {
+			for i := 0; i < n; i++ {
+				t := (i + j) % n
+				if rng.Float64() >= beta || !g.has(i, t) || g.deg[i] >= n-1 {
+					continue
+				}
+
+				for {
+					r := rng.Intn(n)
+					if r != i && !g.has(i, r) {
+						g.remove(i, t)
+						g.add(i, r)
+						break
+					}
+				}
+			}
+		}
+	case "scale-free":
+		m, err := topologyInt(name, params, 1)
+		if err != nil {
+			return nil, err
+		}
+
+		if m >= n {
+			return nil, fmt.Errorf("scale-free: m %d requires more than %d nodes", m, n)
+		}
+
+		// Barabasi-Albert: starting from a clique of m+1 nodes, every new node
+		// attaches to m existing nodes, picked proportionally to their degree
+		var targets []int
+		for i := 0; i <= m; i++ {
+			for j := i + 1; j <= m; j++ {
+				g.add(i, j)
+				targets = append(targets, i, j)
+			}
+		}
+
+		for i := m + 1; i < n; i++ {
+			picked := make(map[int]bool)
+			for len(picked) < m {
+				picked[targets[rng.Intn(len(targets))]] = true
+			}
+
+			var peers []int
+			for p := range picked {
+				peers = append(peers, p)
+			}
+			sort.Ints(peers)
+
+			for _, p := range peers {
+				g.add(i, p)
+				targets = append(targets, i, p)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown topology %s", name)
+	}
+
+	out := make([]edge, len(g.edges))
+	for i, e := range g.edges {
+		out[i] = edge{list[e.From], list[e.To]}
+	}
+
+	return out, nil
+}
+
+func topologyInt(name, param string, min int) (int, error) {
+	v, err := strconv.Atoi(param)
+	if err != nil || v < min {
+		return 0, fmt.Errorf("%s: expected an integer of at least %d, got %q", name, min, param)
+	}
+
+	return v, nil
+}
+
+// readEdges parses an edge list, one `<from> <to>` pair of node indexes per
+// line. Pairs may also be separated by a comma, lines starting with '#' are
+// ignored. Connections go both ways, so a pair listed again, in either order,
+// is skipped.
+func readEdges(r io.Reader) ([]edge, error) {
+	var out []edge
+	seen := make(map[edge]bool)
+
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.FieldsFunc(text, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})
+
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("parse error on line %d: expected two node indexes", line)
+		}
+
+		from, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("parse error on line %d: %s", line, err)
+		}
+
+		to, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("parse error on line %d: %s", line, err)
+		}
+
+		if from < 0 || to < 0 {
+			return nil, fmt.Errorf("parse error on line %d: node indexes can not be negative", line)
+		}
+
+		if from == to {
+			return nil, fmt.Errorf("parse error on line %d: node %d can not connect to itself", line, from)
+		}
+
+		if seen[edge{from, to}] || seen[edge{to, from}] {
+			continue
+		}
+
+		seen[edge{from, to}] = true
+		out = append(out, edge{from, to})
+	}
+
+	return out, scanner.Err()
+}
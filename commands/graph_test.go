@@ -0,0 +1,75 @@
+package commands
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestBuildTopology(t *testing.T) {
+	cases := []struct {
+		spec          string
+		list          []int
+		expectedEdges []edge
+	}{
+		{"line", []int{0, 1, 2}, []edge{{0, 1}, {1, 2}}},
+		{"ring", []int{0, 1, 2}, []edge{{0, 1}, {1, 2}, {0, 2}}},
+		{"ring", []int{3, 4}, []edge{{3, 4}}},
+		{"star:5", []int{4, 5, 6}, []edge{{4, 5}, {5, 6}}},
+		{"tree:2", []int{0, 1, 2, 3, 4}, []edge{{0, 1}, {0, 2}, {1, 3}, {1, 4}}},
+		{"erdos-renyi:1", []int{0, 1, 2}, []edge{{0, 1}, {0, 2}, {1, 2}}},
+	}
+
+	for _, c := range cases {
+		edges, err := buildTopology(c.spec, c.list, rand.New(rand.NewSource(1)))
+
+		expect(t, err, nil)
+		expect(t, edges, c.expectedEdges)
+	}
+}
+
+func TestBuildRandomTopology(t *testing.T) {
+	list := make([]int, 50)
+	for i := range list {
+		list[i] = i
+	}
+
+	for _, spec := range []string{"random:3", "small-world:4,0.2", "scale-free:2"} {
+		a, err := buildTopology(spec, list, rand.New(rand.NewSource(42)))
+		expect(t, err, nil)
+
+		b, err := buildTopology(spec, list, rand.New(rand.NewSource(42)))
+		expect(t, err, nil)
+
+		// The same seed must always produce the same topology
+		expect(t, a, b)
+
+		degree := make(map[int]int)
+		for _, e := range a {
+			degree[e.From]++
+			degree[e.To]++
+		}
+
+		expect(t, len(degree), len(list))
+	}
+}
+
+func TestReadEdges(t *testing.T) {
+	input := "# comment\n0 1\n\n1,2\n3\t4\n1 0\n1 2\n"
+
+	edges, err := readEdges(strings.NewReader(input))
+
+	expect(t, err, nil)
+	expect(t, edges, []edge{{0, 1}, {1, 2}, {3, 4}})
+
+	_, err = readEdges(strings.NewReader("0 1\n3 3\n"))
+	expect(t, err.Error(), "parse error on line 2: node 3 can not connect to itself")
+
+	_, err = readEdges(strings.NewReader("0 1\n0 -1\n"))
+	expect(t, err.Error(), "parse error on line 2: node indexes can not be negative")
+
+	_, err = readEdges(strings.NewReader("0 1 2\n"))
+	if err == nil {
+		t.Errorf("expected parse error")
+	}
+}
@@ -0,0 +1,282 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	cli "github.com/urfave/cli"
+
+	"github.com/ipfs/iptb/testbed"
+	testbedi "github.com/ipfs/iptb/testbed/interfaces"
+)
+
+var HealthCmd = cli.Command{
+	Category:  "METRICS",
+	Name:      "health",
+	Usage:     "check the heartbeat of specified nodes (or all)",
+	ArgsUsage: "[nodes]",
+	Description: `
+The health command asks every node for its heartbeat, and prints the values
+it reported as a table. Nodes whose heartbeat fails, or takes longer than
+--deadline, are unhealthy.
+
+$ iptb health
+NODE  STATUS     peers  uptime  ERROR
+0     healthy    3      1m12s
+1     unhealthy                 node[1]: no heartbeat within 5s
+
+With --watch, nodes are checked every --interval until iptb is interrupted,
+and an alert is printed on stderr whenever a node becomes unhealthy.
+`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "deadline",
+			Usage: "maximum duration of the heartbeat of a node",
+			Value: "5s",
+		},
+		cli.BoolFlag{
+			Name:  "watch",
+			Usage: "check nodes periodically, alerting when one becomes unhealthy",
+		},
+		cli.StringFlag{
+			Name:  "interval",
+			Usage: "delay between two checks with --watch",
+			Value: "10s",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		flagRoot := c.GlobalString("IPTB_ROOT")
+		flagTestbed := c.GlobalString("testbed")
+		flagFormat := c.GlobalString("format")
+		flagAllowFailures := c.GlobalInt("allow-failures")
+		flagWatch := c.Bool("watch")
+
+		deadline, err := time.ParseDuration(c.String("deadline"))
+		if err != nil {
+			return NewUsageError(fmt.Sprintf("invalid deadline %s: %s", c.String("deadline"), err))
+		}
+
+		interval, err := time.ParseDuration(c.String("interval"))
+		if err != nil {
+			return NewUsageError(fmt.Sprintf("invalid interval %s: %s", c.String("interval"), err))
+		}
+
+		if flagWatch && flagFormat == formatJSON {
+			return NewUsageError("--watch can not be used with --format json, use ndjson")
+		}
+
+		tb := testbed.NewTestbed(path.Join(flagRoot, "testbeds", flagTestbed))
+		nodes, err := tb.Nodes()
+		if err != nil {
+			return err
+		}
+
+		nodeRange := c.Args().First()
+
+		if nodeRange == "" {
+			nodeRange = fmt.Sprintf("[0-%d]", len(nodes)-1)
+		}
+
+		list, err := parseRange(nodeRange)
+		if err != nil {
+			return fmt.Errorf("could not parse node range %s", nodeRange)
+		}
+
+		m, err := newMapper(c)
+		if err != nil {
+			return err
+		}
+
+		// Progress would be interleaved with the tables
+		if flagWatch {
+			m.progress = nil
+		}
+
+		if !flagWatch {
+			records, results, err := checkHealth(m, list, nodes, deadline)
+			if err != nil {
+				return err
+			}
+
+			if err := writeHealth(c.App.Writer, flagFormat, records); err != nil {
+				return err
+			}
+
+			return checkFailures(results, flagAllowFailures)
+		}
+
+		healthy := make(map[int]bool)
+		for {
+			records, _, err := checkHealth(m, list, nodes, deadline)
+			if err != nil {
+				return err
+			}
+
+			if m.context().Err() != nil {
+				return nil
+			}
+
+			if flagFormat == formatText {
+				fmt.Fprintf(c.App.Writer, "%s\n", time.Now().Format("15:04:05"))
+			}
+
+			if err := writeHealth(c.App.Writer, flagFormat, records); err != nil {
+				return err
+			}
+
+			for _, rec := range records {
+				if was, ok := healthy[rec.Node]; ok && was && !rec.Healthy {
+					fmt.Fprintf(c.App.ErrWriter, "ALERT unhealthy %s\n", rec.Error.Message)
+				}
+
+				healthy[rec.Node] = rec.Healthy
+			}
+
+			select {
+			case <-time.After(interval):
+			case <-m.context().Done():
+				return nil
+			}
+		}
+	},
+}
+
+// healthRecord is the health of a node, with the values of its heartbeat
+type healthRecord struct {
+	Time    time.Time         `json:"time"`
+	Node    int               `json:"node"`
+	Healthy bool              `json:"healthy"`
+	Values  map[string]string `json:"values"`
+	Error   *ErrorRecord      `json:"error"`
+}
+
+// checkHealth asks every node of list for its heartbeat
+func checkHealth(m *mapper, list []int, nodes []testbedi.Core, deadline time.Duration) ([]healthRecord, []Result, error) {
+	var lk sync.Mutex
+	values := make(map[int]map[string]string)
+
+	results, err := m.mapWithOutput(list, nodes, func(ctx context.Context, n int, node testbedi.Core) (testbedi.Output, error) {
+		hb, err := heartbeat(ctx, node, deadline)
+		if err != nil {
+			return nil, err
+		}
+
+		lk.Lock()
+		values[n] = hb
+		lk.Unlock()
+
+		return nil, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	records := make([]healthRecord, 0, len(results))
+	for _, rs := range results {
+		records = append(records, healthRecord{
+			Time:    now,
+			Node:    rs.Node,
+			Healthy: rs.Error == nil,
+			Values:  values[rs.Node],
+			Error:   NewErrorRecord(rs.Error),
+		})
+	}
+
+	return records, results, nil
+}
+
+// heartbeat calls the Heartbeat of a node, which takes no context, giving up
+// once deadline elapsed
+func heartbeat(ctx context.Context, node testbedi.Core, deadline time.Duration) (map[string]string, error) {
+	metricNode, ok := metricsOf(node)
+	if !ok {
+		return nil, fmt.Errorf("node does not implement metrics")
+	}
+
+	type beat struct {
+		values map[string]string
+		err    error
+	}
+
+	done := make(chan beat, 1)
+	go func() {
+		values, err := metricNode.Heartbeat()
+		done <- beat{values, err}
+	}()
+
+	timer := time.NewTimer(deadline)
+	defer timer.Stop()
+
+	select {
+	case b := <-done:
+		return b.values, b.err
+	case <-timer.C:
+		return nil, fmt.Errorf("no heartbeat within %s", deadline)
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	}
+}
+
+func writeHealth(w io.Writer, format string, records []healthRecord) error {
+	return writeFormatted(w, format, records, func(w io.Writer) error {
+		return healthTable(w, records)
+	})
+}
+
+// healthTable prints a row per node, with a column per heartbeat key
+func healthTable(w io.Writer, records []healthRecord) error {
+	keys := make(map[string]bool)
+	failed := false
+	for _, rec := range records {
+		for k := range rec.Values {
+			keys[k] = true
+		}
+
+		failed = failed || rec.Error != nil
+	}
+
+	var columns []string
+	for k := range keys {
+		columns = append(columns, k)
+	}
+
+	sort.Strings(columns)
+
+	header := append([]string{"NODE", "STATUS"}, columns...)
+	if failed {
+		header = append(header, "ERROR")
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "%s\n", strings.Join(header, "\t"))
+
+	for _, rec := range records {
+		status := "healthy"
+		if !rec.Healthy {
+			status = "unhealthy"
+		}
+
+		row := []string{fmt.Sprintf("%d", rec.Node), status}
+		for _, k := range columns {
+			row = append(row, rec.Values[k])
+		}
+
+		if rec.Error != nil {
+			row = append(row, rec.Error.Message)
+		} else if failed {
+			row = append(row, "")
+		}
+
+		fmt.Fprintf(tw, "%s\n", strings.Join(row, "\t"))
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,23 @@
+package commands
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestHealthTable(t *testing.T) {
+	records := []healthRecord{
+		{Node: 0, Healthy: true, Values: map[string]string{"uptime": "1m", "peers": "3"}},
+		{Node: 1, Error: NewErrorRecord(errors.New("node[1]: no heartbeat within 5s"))},
+	}
+
+	var buf bytes.Buffer
+	err := healthTable(&buf, records)
+
+	expect(t, err, nil)
+	expect(t, buf.String(), ""+
+		"NODE  STATUS     peers  uptime  ERROR\n"+
+		"0     healthy    3      1m      \n"+
+		"1     unhealthy                 node[1]: no heartbeat within 5s\n")
+}
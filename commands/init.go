@@ -9,6 +9,7 @@ import (
 
 	"github.com/ipfs/iptb/testbed"
 	testbedi "github.com/ipfs/iptb/testbed/interfaces"
+	"github.com/ipfs/iptb/testbed/netns"
 )
 
 var InitCmd = cli.Command{
@@ -17,6 +18,10 @@ var InitCmd = cli.Command{
 	Usage:     "initialize specified nodes (or all)",
 	ArgsUsage: "[nodes] -- [arguments...]",
 	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "timeout",
+			Usage: "maximum duration of the command on every node, e.g. 30s",
+		},
 		cli.BoolFlag{
 			Name:   "terminator",
 			Hidden: true,
@@ -33,6 +38,8 @@ var InitCmd = cli.Command{
 		flagRoot := c.GlobalString("IPTB_ROOT")
 		flagTestbed := c.GlobalString("testbed")
 		flagQuiet := c.GlobalBool("quiet")
+		flagFormat := c.GlobalString("format")
+		flagAllowFailures := c.GlobalInt("allow-failures")
 
 		tb := testbed.NewTestbed(path.Join(flagRoot, "testbeds", flagTestbed))
 		nodes, err := tb.Nodes()
@@ -51,15 +58,25 @@ var InitCmd = cli.Command{
 			return fmt.Errorf("could not parse node range %s", nodeRange)
 		}
 
-		runCmd := func(node testbedi.Core) (testbedi.Output, error) {
-			return node.Init(context.Background(), args...)
+		runCmd := func(ctx context.Context, n int, node testbedi.Core) (testbedi.Output, error) {
+			return node.Init(ctx, args...)
+		}
+
+		nw, err := netns.Load(tb.Dir())
+		if err != nil {
+			return err
+		}
+
+		m, err := newMapper(c)
+		if err != nil {
+			return err
 		}
 
-		results, err := mapWithOutput(list, nodes, runCmd)
+		results, err := m.mapWithOutput(list, nodes, inNetns(nw, runCmd))
 		if err != nil {
 			return err
 		}
 
-		return buildReport(results, flagQuiet)
+		return buildReport(results, flagQuiet, flagFormat, flagAllowFailures)
 	},
 }
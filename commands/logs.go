@@ -1,6 +1,7 @@
 package commands
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"path"
@@ -31,6 +32,8 @@ var LogsCmd = cli.Command{
 		flagRoot := c.GlobalString("IPTB_ROOT")
 		flagTestbed := c.GlobalString("testbed")
 		flagQuiet := c.GlobalBool("quiet")
+		flagFormat := c.GlobalString("format")
+		flagAllowFailures := c.GlobalInt("allow-failures")
 		flagErr := c.BoolT("err")
 		flagOut := c.BoolT("out")
 
@@ -51,7 +54,7 @@ var LogsCmd = cli.Command{
 			return err
 		}
 
-		runCmd := func(node testbedi.Core) (testbedi.Output, error) {
+		runCmd := func(ctx context.Context, n int, node testbedi.Core) (testbedi.Output, error) {
 			metricNode, ok := node.(testbedi.Metric)
 			if !ok {
 				return nil, fmt.Errorf("node does not implement metrics")
@@ -79,12 +82,17 @@ var LogsCmd = cli.Command{
 			return NewOutput(stdout, stderr), nil
 		}
 
-		results, err := mapWithOutput(list, nodes, runCmd)
+		m, err := newMapper(c)
 		if err != nil {
 			return err
 		}
 
-		return buildReport(results, flagQuiet)
+		results, err := m.mapWithOutput(list, nodes, runCmd)
+		if err != nil {
+			return err
+		}
+
+		return buildReport(results, flagQuiet, flagFormat, flagAllowFailures)
 	},
 }
 
@@ -1,9 +1,17 @@
 package commands
 
 import (
+	"context"
+	"encoding/csv"
 	"fmt"
+	"io"
+	"math"
 	"path"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
 
 	cli "github.com/urfave/cli"
 
@@ -14,24 +22,67 @@ import (
 var MetricCmd = cli.Command{
 	Category:  "METRICS",
 	Name:      "metric",
-	Usage:     "get metric from node",
-	ArgsUsage: "<node> [metric]",
+	Aliases:   []string{"metrics"},
+	Usage:     "get metrics from specified nodes (or all)",
+	ArgsUsage: "<node> | [nodes] <metric...>",
+	Description: `
+With a single node, the metric command lists the metrics the node provides.
+With metrics, it prints their value on every node as a table:
+
+$ iptb metric --aggregate all [0-2] peers bw_in
+NODE  peers  bw_in
+0     3      1200
+1     2      800
+2     3      950
+min   2      800
+max   3      1200
+...
+
+Metrics are read from every node when no node range is given. Aggregates are
+computed over numeric values, and are any of min, max, mean, p50, p95 and sum,
+separated by commas, or all of them.
+
+A single metric of a single node, e.g. 'iptb metric 0 peers', prints its value
+alone. Use --csv to print the table as csv.
+
+Nodes running as a local process whose pid is known to their plugin also
+report proc_* metrics, read from /proc for the process and its children: cpu
+time, resident memory, threads, open fds and sockets, and io bytes.
+
+Metrics can also be sampled over time with 'iptb metric record', or exposed
+to prometheus with 'iptb metrics serve'.
+`,
+	Subcommands: []cli.Command{
+		MetricRecordCmd,
+		MetricServeCmd,
+	},
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "aggregate",
+			Usage: "aggregates of every metric, e.g. min,max,p95 or all",
+		},
+		cli.BoolFlag{
+			Name:  "csv",
+			Usage: "print the table as csv",
+		},
+	},
 	Action: func(c *cli.Context) error {
-		if c.NArg() == 1 {
-			return metricList(c)
+		if c.NArg() == 0 {
+			return NewUsageError("metric takes at least 1 argument")
 		}
 
-		if c.NArg() == 2 {
-			return metricGet(c)
+		if _, err := strconv.Atoi(c.Args().First()); err == nil && c.NArg() == 1 {
+			return metricList(c)
 		}
 
-		return NewUsageError("metric takes 1 or 2 arguments only")
+		return metricTable(c)
 	},
 }
 
 func metricList(c *cli.Context) error {
 	flagRoot := c.GlobalString("IPTB_ROOT")
 	flagTestbed := c.GlobalString("testbed")
+	flagFormat := c.GlobalString("format")
 
 	i, err := strconv.Atoi(c.Args().First())
 	if err != nil {
@@ -45,54 +96,321 @@ func metricList(c *cli.Context) error {
 		return err
 	}
 
-	metricNode, ok := node.(testbedi.Metric)
+	metricNode, ok := metricsOf(node)
 	if !ok {
 		return fmt.Errorf("node does not implement metrics")
 	}
 
-	metricList := metricNode.GetMetricList()
-	for _, m := range metricList {
+	var recs []descRecord
+	for _, m := range metricNode.GetMetricList() {
 		desc, err := metricNode.GetMetricDesc(m)
 		if err != nil {
 			return fmt.Errorf("error getting metric description: %s", err)
 		}
 
-		fmt.Fprintf(c.App.Writer, "\t%s: %s\n", m, desc)
+		recs = append(recs, descRecord{
+			Name:        m,
+			Description: desc,
+		})
 	}
 
-	return nil
+	return writeFormatted(c.App.Writer, flagFormat, recs, func(w io.Writer) error {
+		for _, r := range recs {
+			fmt.Fprintf(w, "\t%s: %s\n", r.Name, r.Description)
+		}
+
+		return nil
+	})
 }
 
-func metricGet(c *cli.Context) error {
+func metricTable(c *cli.Context) error {
 	flagRoot := c.GlobalString("IPTB_ROOT")
 	flagTestbed := c.GlobalString("testbed")
+	flagFormat := c.GlobalString("format")
+	flagAllowFailures := c.GlobalInt("allow-failures")
+	flagCSV := c.Bool("csv")
 
-	argNode := c.Args()[0]
-	argMetric := c.Args()[1]
-
-	i, err := strconv.Atoi(argNode)
+	aggregates, err := parseAggregates(c.String("aggregate"))
 	if err != nil {
-		return fmt.Errorf("parse err: %s", err)
+		return err
 	}
 
 	tb := testbed.NewTestbed(path.Join(flagRoot, "testbeds", flagTestbed))
+	nodes, err := tb.Nodes()
+	if err != nil {
+		return err
+	}
 
-	node, err := tb.Node(i)
+	args := c.Args()
+	nodeRange := fmt.Sprintf("[0-%d]", len(nodes)-1)
+	if _, err := parseRange(args[0]); err == nil {
+		nodeRange, args = args[0], args[1:]
+	}
+
+	if len(args) == 0 {
+		return NewUsageError("metric requires at least one metric")
+	}
+
+	list, err := parseRange(nodeRange)
+	if err != nil {
+		return fmt.Errorf("could not parse node range %s", nodeRange)
+	}
+
+	var lk sync.Mutex
+	values := make(map[int]map[string]string)
+
+	runCmd := func(ctx context.Context, n int, node testbedi.Core) (testbedi.Output, error) {
+		metricNode, ok := metricsOf(node)
+		if !ok {
+			return nil, fmt.Errorf("node does not implement metrics")
+		}
+
+		var errs []error
+		vals := make(map[string]string)
+		for _, key := range args {
+			value, err := metricNode.Metric(key)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", key, err))
+				continue
+			}
+
+			vals[key] = value
+		}
+
+		lk.Lock()
+		values[n] = vals
+		lk.Unlock()
+
+		if len(errs) != 0 {
+			return nil, cli.NewMultiError(errs...)
+		}
+
+		return nil, nil
+	}
+
+	m, err := newMapper(c)
 	if err != nil {
 		return err
 	}
 
-	metricNode, ok := node.(testbedi.Metric)
-	if !ok {
-		return fmt.Errorf("node does not implement metrics")
+	results, err := m.mapWithOutput(list, nodes, runCmd)
+	if err != nil {
+		return err
+	}
+
+	// A single metric of a single node prints its value alone, as it always did
+	isSingle := c.NArg() == 2 && len(results) == 1 && !strings.HasPrefix(nodeRange, "[")
+	if isSingle && len(aggregates) == 0 && !flagCSV && results[0].Error == nil {
+		rec := valueRecord{
+			Node:  results[0].Node,
+			Name:  args[0],
+			Value: values[results[0].Node][args[0]],
+		}
+
+		return writeFormatted(c.App.Writer, flagFormat, rec, func(w io.Writer) error {
+			_, err := fmt.Fprintf(w, "%s\n", rec.Value)
+			return err
+		})
+	}
+
+	table := metricsTable{}
+	for _, rs := range results {
+		table.Nodes = append(table.Nodes, metricRecord{
+			Node:   rs.Node,
+			Values: values[rs.Node],
+			Error:  NewErrorRecord(rs.Error),
+		})
+	}
+
+	if len(aggregates) != 0 {
+		table.Aggregates = make(map[string]map[string]float64)
+		for _, key := range args {
+			var column []string
+			for _, rec := range table.Nodes {
+				if v, ok := rec.Values[key]; ok {
+					column = append(column, v)
+				}
+			}
+
+			if agg, ok := aggregate(column, aggregates); ok {
+				table.Aggregates[key] = agg
+			}
+		}
+	}
+
+	switch {
+	case flagCSV:
+		err = table.writeCSV(c.App.Writer, args, aggregates)
+	case flagFormat == formatNDJSON:
+		err = writeFormatted(c.App.Writer, flagFormat, table.Nodes, nil)
+		if err == nil && table.Aggregates != nil {
+			err = writeFormatted(c.App.Writer, flagFormat, struct {
+				Aggregates map[string]map[string]float64 `json:"aggregates"`
+			}{table.Aggregates}, nil)
+		}
+	default:
+		err = writeFormatted(c.App.Writer, flagFormat, table, func(w io.Writer) error {
+			return table.writeText(w, args, aggregates)
+		})
 	}
 
-	value, err := metricNode.Metric(argMetric)
 	if err != nil {
 		return err
 	}
 
-	_, err = fmt.Fprintf(c.App.Writer, "%s\n", value)
+	return checkFailures(results, flagAllowFailures)
+}
+
+// metricRecord holds the metrics of a node
+type metricRecord struct {
+	Node   int               `json:"node"`
+	Values map[string]string `json:"values"`
+	Error  *ErrorRecord      `json:"error"`
+}
+
+// metricsTable holds metrics of many nodes, with aggregates of every metric
+// whose values are numeric
+type metricsTable struct {
+	Nodes      []metricRecord                `json:"nodes"`
+	Aggregates map[string]map[string]float64 `json:"aggregates,omitempty"`
+}
+
+// rows returns the rows of the table, starting with its header
+func (t metricsTable) rows(keys, aggregates []string) [][]string {
+	rows := [][]string{append([]string{"NODE"}, keys...)}
+
+	for _, rec := range t.Nodes {
+		row := []string{strconv.Itoa(rec.Node)}
+		for _, key := range keys {
+			value, ok := rec.Values[key]
+			if !ok && rec.Error != nil {
+				value = "-"
+			}
+
+			row = append(row, value)
+		}
+
+		rows = append(rows, row)
+	}
+
+	for _, name := range aggregates {
+		row := []string{name}
+		for _, key := range keys {
+			value := ""
+			if agg, ok := t.Aggregates[key]; ok {
+				// Rounded, as means rarely fall on round numbers
+				value = strconv.FormatFloat(math.Round(agg[name]*1000)/1000, 'f', -1, 64)
+			}
+
+			row = append(row, value)
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows
+}
+
+func (t metricsTable) writeText(w io.Writer, keys, aggregates []string) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, row := range t.rows(keys, aggregates) {
+		fmt.Fprintf(tw, "%s\n", strings.Join(row, "\t"))
+	}
+
+	return tw.Flush()
+}
+
+func (t metricsTable) writeCSV(w io.Writer, keys, aggregates []string) error {
+	cw := csv.NewWriter(w)
+	if err := cw.WriteAll(t.rows(keys, aggregates)); err != nil {
+		return err
+	}
+
+	return cw.Error()
+}
+
+// aggregateNames lists the aggregates of metrics, in the order they are shown
+var aggregateNames = []string{"min", "max", "mean", "p50", "p95", "sum"}
+
+// parseAggregates parses a comma separated list of aggregates, where all
+// stands for every aggregate
+func parseAggregates(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	if s == "all" {
+		return aggregateNames, nil
+	}
+
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		found := false
+		for _, known := range aggregateNames {
+			found = found || name == known
+		}
+
+		if !found {
+			return nil, NewUsageError(fmt.Sprintf("unknown aggregate %s, expected one of %s", name, strings.Join(aggregateNames, ", ")))
+		}
+
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+// aggregate computes the aggregates of values. It returns false when there are
+// no values, or when a value is not a number.
+func aggregate(values []string, names []string) (map[string]float64, bool) {
+	if len(values) == 0 {
+		return nil, false
+	}
+
+	nums := make([]float64, 0, len(values))
+	for _, v := range values {
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return nil, false
+		}
+
+		nums = append(nums, f)
+	}
+
+	sort.Float64s(nums)
+
+	var sum float64
+	for _, f := range nums {
+		sum += f
+	}
+
+	out := make(map[string]float64)
+	for _, name := range names {
+		switch name {
+		case "min":
+			out[name] = nums[0]
+		case "max":
+			out[name] = nums[len(nums)-1]
+		case "mean":
+			out[name] = sum / float64(len(nums))
+		case "p50":
+			out[name] = percentile(nums, 50)
+		case "p95":
+			out[name] = percentile(nums, 95)
+		case "sum":
+			out[name] = sum
+		}
+	}
+
+	return out, true
+}
+
+// percentile returns the p-th percentile of sorted values, by nearest rank
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
 
-	return err
+	return sorted[rank-1]
 }
@@ -0,0 +1,41 @@
+package commands
+
+import (
+	"testing"
+)
+
+func TestAggregate(t *testing.T) {
+	agg, ok := aggregate([]string{"4", "1", "3", " 2\n", "10"}, aggregateNames)
+
+	expect(t, ok, true)
+	expect(t, agg, map[string]float64{
+		"min":  1,
+		"max":  10,
+		"mean": 4,
+		"p50":  3,
+		"p95":  10,
+		"sum":  20,
+	})
+
+	_, ok = aggregate([]string{"1", "n/a"}, aggregateNames)
+	expect(t, ok, false)
+
+	_, ok = aggregate(nil, aggregateNames)
+	expect(t, ok, false)
+}
+
+func TestParseAggregates(t *testing.T) {
+	names, err := parseAggregates("p95,min")
+
+	expect(t, err, nil)
+	expect(t, names, []string{"p95", "min"})
+
+	names, err = parseAggregates("all")
+
+	expect(t, err, nil)
+	expect(t, names, aggregateNames)
+
+	if _, err := parseAggregates("p99"); err == nil {
+		t.Fatal("expected an error for an unknown aggregate")
+	}
+}
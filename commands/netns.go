@@ -0,0 +1,402 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	cli "github.com/urfave/cli"
+
+	"github.com/ipfs/iptb/testbed"
+	testbedi "github.com/ipfs/iptb/testbed/interfaces"
+	"github.com/ipfs/iptb/testbed/netns"
+)
+
+var NetnsCmd = cli.Command{
+	Category: "NETWORK",
+	Name:     "netns",
+	Usage:    "isolate nodes in network namespaces and shape their traffic",
+	Description: `
+The netns command places every node of a testbed in its own linux network
+namespace. Namespaces are attached through veth pairs to a bridge created for
+the testbed. Setting up namespaces requires root.
+
+Once set up, commands which start processes for a node (init, start, run,
+shell, ...) transparently enter the namespace of the node. Nodes listen on the
+address of their namespace rather than on loopback, so that other nodes, and
+the requests plugins make from the host, reach them through the bridge. Only
+plugins which can move the addresses of their nodes (Binder) are supported,
+nodes take their new addresses from their next init or start.
+
+Traffic can be shaped per node, using the attributes latency, jitter,
+bandwidth and packet_loss, or per link from one node to another:
+
+$ iptb testbed create -count 5 -type <type> -attr latency,50ms -netns
+$ iptb netns shape 0 [1-4] --latency 200ms --loss 1%
+`,
+	Subcommands: []cli.Command{
+		NetnsSetupCmd,
+		NetnsShapeCmd,
+		NetnsShowCmd,
+		NetnsTeardownCmd,
+	},
+}
+
+var NetnsSetupCmd = cli.Command{
+	Name:  "setup",
+	Usage: "create a network namespace for every node",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "subnet",
+			Usage: "subnet to allocate node addresses from",
+			Value: "10.77.0.0/16",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		flagRoot := c.GlobalString("IPTB_ROOT")
+		flagTestbed := c.GlobalString("testbed")
+		flagSubnet := c.String("subnet")
+
+		tb := testbed.NewTestbed(path.Join(flagRoot, "testbeds", flagTestbed))
+
+		return setupNetns(tb, flagSubnet)
+	},
+}
+
+var NetnsShapeCmd = cli.Command{
+	Name:      "shape",
+	Usage:     "shape traffic of nodes, or of links between sets of nodes",
+	ArgsUsage: "[nodes] [nodes]",
+	Description: `
+Without arguments, the shape of every node is read again from its attributes
+and reapplied. With a single set of nodes, the flags replace the shape of those
+nodes. With two sets, the flags shape the traffic sent from every node of the
+first set to every node of the second set.
+`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "latency",
+			Usage: "delay added to every packet, e.g. 50ms",
+		},
+		cli.StringFlag{
+			Name:  "jitter",
+			Usage: "variation of the delay, e.g. 10ms",
+		},
+		cli.StringFlag{
+			Name:  "bandwidth",
+			Usage: "rate limit, e.g. 10mbit",
+		},
+		cli.StringFlag{
+			Name:  "loss",
+			Usage: "percentage of packets dropped, e.g. 0.5%",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		flagRoot := c.GlobalString("IPTB_ROOT")
+		flagTestbed := c.GlobalString("testbed")
+
+		tb := testbed.NewTestbed(path.Join(flagRoot, "testbeds", flagTestbed))
+
+		nw, err := netns.Load(tb.Dir())
+		if err != nil {
+			return err
+		}
+
+		if nw == nil {
+			return fmt.Errorf("testbed does not use network namespaces")
+		}
+
+		shape := netns.Shape{
+			Latency:   c.String("latency"),
+			Jitter:    c.String("jitter"),
+			Bandwidth: c.String("bandwidth"),
+			Loss:      normalizeLoss(c.String("loss")),
+		}
+
+		switch c.NArg() {
+		case 0:
+			specs, err := tb.Specs()
+			if err != nil {
+				return err
+			}
+
+			nodes, err := tb.Nodes()
+			if err != nil {
+				return err
+			}
+
+			for i, n := range nw.Nodes {
+				if i < len(specs) {
+					n.Shape = nodeShape(specs[i], nodes[i])
+				}
+			}
+		case 1:
+			list, err := parseRange(c.Args()[0])
+			if err != nil {
+				return err
+			}
+
+			for _, i := range list {
+				n, err := nw.Node(i)
+				if err != nil {
+					return err
+				}
+
+				n.Shape = shape
+			}
+		case 2:
+			from, err := parseRange(c.Args()[0])
+			if err != nil {
+				return err
+			}
+
+			to, err := parseRange(c.Args()[1])
+			if err != nil {
+				return err
+			}
+
+			for _, f := range from {
+				for _, t := range to {
+					if f == t {
+						continue
+					}
+
+					if err := validRange([]int{f, t}, len(nw.Nodes)); err != nil {
+						return err
+					}
+
+					nw.SetLink(f, t, shape)
+				}
+			}
+		default:
+			return NewUsageError("shape accepts between 0 and 2 arguments")
+		}
+
+		if err := nw.Save(tb.Dir()); err != nil {
+			return err
+		}
+
+		return nw.Shape()
+	},
+}
+
+var NetnsShowCmd = cli.Command{
+	Name:  "show",
+	Usage: "list the namespaces, addresses and shaping of nodes",
+	Action: func(c *cli.Context) error {
+		flagRoot := c.GlobalString("IPTB_ROOT")
+		flagTestbed := c.GlobalString("testbed")
+		flagFormat := c.GlobalString("format")
+
+		tb := testbed.NewTestbed(path.Join(flagRoot, "testbeds", flagTestbed))
+
+		nw, err := netns.Load(tb.Dir())
+		if err != nil {
+			return err
+		}
+
+		if nw == nil {
+			return fmt.Errorf("testbed does not use network namespaces")
+		}
+
+		return writeFormatted(c.App.Writer, flagFormat, nw, func(w io.Writer) error {
+			fmt.Fprintf(w, "bridge %s %s\n", nw.Bridge, nw.Gateway)
+			for _, n := range nw.Nodes {
+				fmt.Fprintf(w, "node[%d] %s %s %s\n", n.Index, n.Netns, n.Addr, formatShape(n.Shape))
+			}
+
+			for _, l := range nw.Links {
+				fmt.Fprintf(w, "node[%d] => node[%d] %s\n", l.From, l.To, formatShape(l.Shape))
+			}
+
+			return nil
+		})
+	},
+}
+
+var NetnsTeardownCmd = cli.Command{
+	Name:  "teardown",
+	Usage: "remove every namespace, interface and bridge of the testbed",
+	Action: func(c *cli.Context) error {
+		flagRoot := c.GlobalString("IPTB_ROOT")
+		flagTestbed := c.GlobalString("testbed")
+
+		tb := testbed.NewTestbed(path.Join(flagRoot, "testbeds", flagTestbed))
+
+		nw, err := netns.Load(tb.Dir())
+		if err != nil {
+			return err
+		}
+
+		if nw == nil {
+			return nil
+		}
+
+		if err := nw.Teardown(); err != nil {
+			return err
+		}
+
+		if err := bindNodes(tb, nw, false); err != nil {
+			return err
+		}
+
+		return netns.Remove(tb.Dir())
+	},
+}
+
+func setupNetns(tb testbed.BasicTestbed, subnet string) error {
+	nw, err := netns.Load(tb.Dir())
+	if err != nil {
+		return err
+	}
+
+	if nw != nil {
+		return fmt.Errorf("testbed already uses network namespaces")
+	}
+
+	specs, err := tb.Specs()
+	if err != nil {
+		return err
+	}
+
+	nodes, err := tb.Nodes()
+	if err != nil {
+		return err
+	}
+
+	// Nodes listening on loopback could not be reached from other namespaces
+	for i, node := range nodes {
+		if _, ok := node.(testbedi.Binder); !ok {
+			return fmt.Errorf("node[%d]: %s nodes can not listen on the address of a network namespace", i, node.Type())
+		}
+	}
+
+	var dirs []string
+	for _, spec := range specs {
+		dirs = append(dirs, spec.Dir)
+	}
+
+	nw, err = netns.New(tb.Dir(), dirs, subnet)
+	if err != nil {
+		return err
+	}
+
+	for i, n := range nw.Nodes {
+		n.Shape = nodeShape(specs[i], nodes[i])
+	}
+
+	// The network is recorded before it is created so that a partial setup
+	// can still be torn down
+	if err := nw.Save(tb.Dir()); err != nil {
+		return err
+	}
+
+	if err := nw.Setup(); err != nil {
+		return err
+	}
+
+	return bindNodes(tb, nw, true)
+}
+
+// bindNodes moves the addresses of nodes to their namespaces, or back to their
+// defaults when bind is false
+func bindNodes(tb testbed.BasicTestbed, nw *netns.Network, bind bool) error {
+	nodes, err := tb.Nodes()
+	if err != nil {
+		return err
+	}
+
+	for i, node := range nodes {
+		binder, ok := node.(testbedi.Binder)
+		if !ok {
+			continue
+		}
+
+		n, err := nw.Node(i)
+		if err != nil {
+			return err
+		}
+
+		ip := ""
+		if bind {
+			ip = n.IP()
+		}
+
+		if err := binder.Bind(ip); err != nil {
+			return fmt.Errorf("node[%d]: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// nodeShape reads the network attributes of a node
+func nodeShape(spec *testbed.NodeSpec, node testbedi.Core) netns.Shape {
+	attr := func(name string) string {
+		v, _ := nodeAttr(spec, node, name)
+		return v
+	}
+
+	return netns.Shape{
+		Latency:   attr("latency"),
+		Jitter:    attr("jitter"),
+		Bandwidth: attr("bandwidth"),
+		Loss:      normalizeLoss(attr("packet_loss")),
+	}
+}
+
+func normalizeLoss(loss string) string {
+	if loss == "" || strings.HasSuffix(loss, "%") {
+		return loss
+	}
+
+	return loss + "%"
+}
+
+func formatShape(s netns.Shape) string {
+	if s.Empty() {
+		return "unshaped"
+	}
+
+	var parts []string
+	if s.Latency != "" {
+		parts = append(parts, "latency="+s.Latency)
+	}
+	if s.Jitter != "" {
+		parts = append(parts, "jitter="+s.Jitter)
+	}
+	if s.Bandwidth != "" {
+		parts = append(parts, "bandwidth="+s.Bandwidth)
+	}
+	if s.Loss != "" {
+		parts = append(parts, "loss="+s.Loss)
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// execNetns runs fn within the namespace of the node stored at `dir`, or
+// directly when the testbed does not isolate its nodes
+func execNetns(nw *netns.Network, dir string, fn func() error) error {
+	if nw == nil {
+		return fn()
+	}
+
+	return nw.Exec(dir, fn)
+}
+
+// inNetns wraps fn so it runs within the namespace of the node it is called on
+func inNetns(nw *netns.Network, fn outputFunc) outputFunc {
+	return func(ctx context.Context, n int, node testbedi.Core) (testbedi.Output, error) {
+		var out testbedi.Output
+		err := execNetns(nw, node.Dir(), func() error {
+			var err error
+			out, err = fn(ctx, n, node)
+			return err
+		})
+
+		return out, err
+	}
+}
@@ -0,0 +1,119 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/iptb/testbed"
+	testbedi "github.com/ipfs/iptb/testbed/interfaces"
+	iptbutil "github.com/ipfs/iptb/util"
+)
+
+// testNode is a node whose commands and events are provided by tests
+type testNode struct {
+	index   int
+	run     func(ctx context.Context, stdin io.Reader, args []string) (testbedi.Output, error)
+	events  func() (io.ReadCloser, error)
+	connect func(ctx context.Context, to testbedi.Core) error
+}
+
+// newTestNodes returns n nodes, running commands with run
+func newTestNodes(n int, run func(ctx context.Context, stdin io.Reader, args []string) (testbedi.Output, error)) []testbedi.Core {
+	nodes := make([]testbedi.Core, n)
+	for i := range nodes {
+		nodes[i] = &testNode{index: i, run: run}
+	}
+
+	return nodes
+}
+
+// newTestTestbed writes a testbed of count nodes to a temporary directory,
+// whose nodes are built by newNode from their index
+func newTestTestbed(t *testing.T, count int, newNode func(index int) testbedi.Core) testbed.BasicTestbed {
+	_, err := testbed.RegisterPlugin(testbed.IptbPlugin{
+		PluginName: "test",
+		NewNode: func(dir string, attrs map[string]string) (testbedi.Core, error) {
+			index, err := strconv.Atoi(filepath.Base(dir))
+			if err != nil {
+				return nil, err
+			}
+
+			return newNode(index), nil
+		},
+	}, true)
+	expect(t, err, nil)
+
+	dir := t.TempDir()
+	specs, err := testbed.BuildSpecs(dir, count, "test", nil)
+	expect(t, err, nil)
+	expect(t, testbed.WriteNodeSpecs(dir, specs), nil)
+
+	return testbed.NewTestbed(dir)
+}
+
+// testOutput returns the output of a command which printed stdout and exited
+// with code
+func testOutput(args []string, stdout string, code int) testbedi.Output {
+	return iptbutil.NewOutput(args, []byte(stdout), nil, code, nil)
+}
+
+func (n *testNode) PeerID() (string, error)       { return fmt.Sprintf("Qm%d", n.index), nil }
+func (n *testNode) APIAddr() (string, error)      { return "", nil }
+func (n *testNode) SwarmAddrs() ([]string, error) { return nil, nil }
+
+func (n *testNode) Init(ctx context.Context, args ...string) (testbedi.Output, error) {
+	return nil, nil
+}
+
+func (n *testNode) Start(ctx context.Context, wait bool, args ...string) (testbedi.Output, error) {
+	return nil, nil
+}
+
+func (n *testNode) Stop(ctx context.Context) error { return nil }
+
+func (n *testNode) RunCmd(ctx context.Context, stdin io.Reader, args ...string) (testbedi.Output, error) {
+	if n.run == nil {
+		return nil, fmt.Errorf("no command")
+	}
+
+	return n.run(ctx, stdin, args)
+}
+
+func (n *testNode) Connect(ctx context.Context, to testbedi.Core) error {
+	if n.connect == nil {
+		return nil
+	}
+
+	return n.connect(ctx, to)
+}
+
+func (n *testNode) Shell(ctx context.Context, ns []testbedi.Core) error { return nil }
+func (n *testNode) Dir() string                                         { return fmt.Sprintf("/tmp/iptb-test/%d", n.index) }
+func (n *testNode) Type() string                                        { return "test" }
+func (n *testNode) String() string                                      { return n.Dir() }
+
+func (n *testNode) Events() (io.ReadCloser, error) {
+	if n.events == nil {
+		return nil, fmt.Errorf("no events")
+	}
+
+	return n.events()
+}
+
+func (n *testNode) StderrReader() (io.ReadCloser, error) {
+	return io.NopCloser(strings.NewReader("")), nil
+}
+
+func (n *testNode) StdoutReader() (io.ReadCloser, error) {
+	return io.NopCloser(strings.NewReader("")), nil
+}
+
+func (n *testNode) Heartbeat() (map[string]string, error)    { return map[string]string{}, nil }
+func (n *testNode) Metric(key string) (string, error)        { return "", fmt.Errorf("no metric %s", key) }
+func (n *testNode) GetMetricList() []string                  { return nil }
+func (n *testNode) GetMetricDesc(key string) (string, error) { return "", nil }
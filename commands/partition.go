@@ -0,0 +1,399 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	cli "github.com/urfave/cli"
+
+	"github.com/ipfs/iptb/testbed"
+	testbedi "github.com/ipfs/iptb/testbed/interfaces"
+	"github.com/ipfs/iptb/testbed/netns"
+)
+
+var PartitionCmd = cli.Command{
+	Category:  "NETWORK",
+	Name:      "partition",
+	Usage:     "split nodes into groups which can not reach each other",
+	ArgsUsage: "<nodes> <nodes> [nodes...]",
+	Description: `
+The partition command makes every group of nodes unreachable from the other
+groups. Nodes not listed in any group are left untouched.
+
+$ iptb partition [0-4] [5-9]
+$ iptb partition show
+$ iptb heal
+
+Partitions are recorded in the testbed, nodes which are started or restarted,
+and connections made through ` + "`iptb connect`" + `, respect them until they are
+healed. A partition is only recorded once it holds: when more than
+--allow-failures blocks fail, those which succeeded are reverted.
+
+When the testbed isolates nodes in network namespaces (see ` + "`iptb netns`" + `),
+traffic between groups is dropped by the network. Otherwise nodes must
+implement filters.
+`,
+	Subcommands: []cli.Command{
+		PartitionShowCmd,
+	},
+	Action: func(c *cli.Context) error {
+		flagRoot := c.GlobalString("IPTB_ROOT")
+		flagTestbed := c.GlobalString("testbed")
+		flagQuiet := c.GlobalBool("quiet")
+		flagFormat := c.GlobalString("format")
+		flagAllowFailures := c.GlobalInt("allow-failures")
+
+		if c.NArg() < 2 {
+			return NewUsageError("partition takes at least 2 arguments")
+		}
+
+		tb := testbed.NewTestbed(path.Join(flagRoot, "testbeds", flagTestbed))
+		nodes, err := tb.Nodes()
+		if err != nil {
+			return err
+		}
+
+		seen := make(map[int]bool)
+		var groups [][]int
+		for _, arg := range c.Args() {
+			list, err := parseRange(arg)
+			if err != nil {
+				return fmt.Errorf("could not parse node range %s", arg)
+			}
+
+			if err := validRange(list, len(nodes)); err != nil {
+				return err
+			}
+
+			for _, n := range list {
+				if seen[n] {
+					return fmt.Errorf("node %d listed in more than one group", n)
+				}
+				seen[n] = true
+			}
+
+			groups = append(groups, list)
+		}
+
+		parts, err := testbed.ReadPartitions(tb.Dir())
+		if err != nil {
+			return err
+		}
+
+		id := 1
+		for _, p := range parts {
+			if p.ID >= id {
+				id = p.ID + 1
+			}
+		}
+
+		part := &testbed.Partition{
+			ID:     id,
+			Groups: groups,
+		}
+
+		nw, err := netns.Load(tb.Dir())
+		if err != nil {
+			return err
+		}
+
+		m, err := newMapper(c)
+		if err != nil {
+			return err
+		}
+
+		var lk sync.Mutex
+		var blocked [][2]int
+		results := m.mapPairs(part.Pairs(), "=/>", func(ctx context.Context, from, to int) error {
+			err := blockNodes(ctx, nw, nodes, from, to, true)
+			if err == nil {
+				lk.Lock()
+				blocked = append(blocked, [2]int{from, to})
+				lk.Unlock()
+
+				// Connections made before the partition are closed when the
+				// node knows how to, otherwise they are left to time out
+				err = disconnectNodes(ctx, nw, nodes, from, to)
+				if errors.Is(err, errNoDisconnect) {
+					err = nil
+				}
+			}
+
+			return err
+		})
+
+		// The partition is only recorded once it holds, otherwise connect
+		// would refuse pairs the network does not separate
+		if err := checkFailures(results, flagAllowFailures); err != nil {
+			return revertPartition(c, m, nw, nodes, parts, blocked, results)
+		}
+
+		if err := testbed.WritePartitions(tb.Dir(), append(parts, part)); err != nil {
+			return err
+		}
+
+		if !flagQuiet && flagFormat == formatText {
+			fmt.Fprintf(c.App.Writer, "partition %d: %s\n", part.ID, formatGroups(part.Groups))
+		}
+
+		return buildReport(results, flagQuiet, flagFormat, flagAllowFailures)
+	},
+}
+
+var PartitionShowCmd = cli.Command{
+	Name:  "show",
+	Usage: "list active partitions",
+	Action: func(c *cli.Context) error {
+		flagRoot := c.GlobalString("IPTB_ROOT")
+		flagTestbed := c.GlobalString("testbed")
+		flagFormat := c.GlobalString("format")
+
+		tb := testbed.NewTestbed(path.Join(flagRoot, "testbeds", flagTestbed))
+
+		parts, err := testbed.ReadPartitions(tb.Dir())
+		if err != nil {
+			return err
+		}
+
+		if parts == nil {
+			parts = []*testbed.Partition{}
+		}
+
+		return writeFormatted(c.App.Writer, flagFormat, parts, func(w io.Writer) error {
+			for _, p := range parts {
+				fmt.Fprintf(w, "partition %d: %s\n", p.ID, formatGroups(p.Groups))
+			}
+
+			return nil
+		})
+	},
+}
+
+var HealCmd = cli.Command{
+	Category:  "NETWORK",
+	Name:      "heal",
+	Usage:     "revert partitions (or all)",
+	ArgsUsage: "[partition]",
+	Action: func(c *cli.Context) error {
+		flagRoot := c.GlobalString("IPTB_ROOT")
+		flagTestbed := c.GlobalString("testbed")
+		flagQuiet := c.GlobalBool("quiet")
+		flagFormat := c.GlobalString("format")
+		flagAllowFailures := c.GlobalInt("allow-failures")
+
+		tb := testbed.NewTestbed(path.Join(flagRoot, "testbeds", flagTestbed))
+		nodes, err := tb.Nodes()
+		if err != nil {
+			return err
+		}
+
+		parts, err := testbed.ReadPartitions(tb.Dir())
+		if err != nil {
+			return err
+		}
+
+		var healed, active []*testbed.Partition
+		if c.Args().Present() {
+			id, err := strconv.Atoi(c.Args().First())
+			if err != nil {
+				return fmt.Errorf("parse err: %s", err)
+			}
+
+			for _, p := range parts {
+				if p.ID == id {
+					healed = append(healed, p)
+				} else {
+					active = append(active, p)
+				}
+			}
+
+			if len(healed) == 0 {
+				return fmt.Errorf("no partition %d", id)
+			}
+		} else {
+			healed = parts
+		}
+
+		nw, err := netns.Load(tb.Dir())
+		if err != nil {
+			return err
+		}
+
+		var pairs [][2]int
+		for _, p := range healed {
+			for _, pair := range p.Pairs() {
+				// Another partition may still keep the pair apart
+				if _, ok := testbed.Separated(active, pair[0], pair[1]); !ok {
+					pairs = append(pairs, pair)
+				}
+			}
+		}
+
+		m, err := newMapper(c)
+		if err != nil {
+			return err
+		}
+
+		results := m.mapPairs(pairs, "=>", func(ctx context.Context, from, to int) error {
+			return blockNodes(ctx, nw, nodes, from, to, false)
+		})
+
+		failed := make(map[[2]int]bool)
+		for i, rs := range results {
+			if rs.Error != nil {
+				failed[pairs[i]] = true
+			}
+		}
+
+		// Partitions which are not fully unblocked stay recorded, so that
+		// heal can be run again
+		for _, p := range healed {
+			for _, pair := range p.Pairs() {
+				if failed[pair] {
+					active = append(active, p)
+
+					if !flagQuiet && flagFormat == formatText {
+						fmt.Fprintf(c.App.ErrWriter, "partition %d is kept, it could not be fully healed\n", p.ID)
+					}
+					break
+				}
+			}
+		}
+
+		if err := testbed.WritePartitions(tb.Dir(), active); err != nil {
+			return err
+		}
+
+		return buildReport(results, flagQuiet, flagFormat, flagAllowFailures)
+	},
+}
+
+// revertTimeout bounds the revert of every block of a failed partition, when
+// the command has no timeout of its own
+const revertTimeout = 30 * time.Second
+
+// revertPartition unblocks the pairs blocked by a partition which failed,
+// besides those active partitions still separate, and reports the failures of
+// both
+func revertPartition(c *cli.Context, m *mapper, nw *netns.Network, nodes []testbedi.Core, parts []*testbed.Partition, blocked [][2]int, results []Result) error {
+	flagQuiet := c.GlobalBool("quiet")
+	flagFormat := c.GlobalString("format")
+	flagAllowFailures := c.GlobalInt("allow-failures")
+
+	var pairs [][2]int
+	for _, pair := range blocked {
+		if _, ok := testbed.Separated(parts, pair[0], pair[1]); !ok {
+			pairs = append(pairs, pair)
+		}
+	}
+
+	// Pairs are reverted even when --fail-fast cancelled the partition
+	rm := &mapper{ctx: rootContext(c), timeout: m.timeout, sem: m.sem}
+	if rm.timeout == 0 {
+		rm.timeout = revertTimeout
+	}
+
+	reverted := rm.mapPairs(pairs, "=>", func(ctx context.Context, from, to int) error {
+		return blockNodes(ctx, nw, nodes, from, to, false)
+	})
+
+	errs := failures(reverted)
+	if !flagQuiet && flagFormat == formatText {
+		fmt.Fprintf(c.App.ErrWriter, "partition failed, %d of %d blocks reverted\n", len(pairs)-len(errs), len(pairs))
+	}
+
+	err := buildReport(results, flagQuiet, flagFormat, flagAllowFailures)
+	if len(errs) == 0 {
+		return err
+	}
+
+	for i, rerr := range errs {
+		errs[i] = fmt.Errorf("could not revert %w", rerr)
+	}
+
+	return cli.NewMultiError(append([]error{err}, errs...)...)
+}
+
+// blockNodes makes node `to` unreachable from node `from`, or reachable again
+// when block is false
+func blockNodes(ctx context.Context, nw *netns.Network, nodes []testbedi.Core, from, to int, block bool) error {
+	if nw != nil {
+		if block {
+			return nw.Block(from, to)
+		}
+
+		return nw.Unblock(from, to)
+	}
+
+	filterNode, ok := nodes[from].(testbedi.Filter)
+	if !ok {
+		return fmt.Errorf("node does not implement filters")
+	}
+
+	if block {
+		return filterNode.Block(ctx, nodes[to])
+	}
+
+	return filterNode.Unblock(ctx, nodes[to])
+}
+
+// enforcePartitions blocks, from every node in list, the nodes active
+// partitions separate it from. Filters of a node may not survive a restart, so
+// this is done after nodes are started.
+func enforcePartitions(ctx context.Context, tb testbed.BasicTestbed, nodes []testbedi.Core, list []int) error {
+	parts, err := testbed.ReadPartitions(tb.Dir())
+	if err != nil || len(parts) == 0 {
+		return err
+	}
+
+	nw, err := netns.Load(tb.Dir())
+	if err != nil {
+		return err
+	}
+
+	// Routes within namespaces outlive the processes of a node
+	if nw != nil {
+		return nil
+	}
+
+	var errs []error
+	for _, n := range list {
+		for _, p := range parts {
+			for _, pair := range p.Pairs() {
+				if pair[0] != n {
+					continue
+				}
+
+				if err := blockNodes(ctx, nw, nodes, pair[0], pair[1], true); err != nil {
+					errs = append(errs, fmt.Errorf("node[%d] =/> node[%d]: %w", pair[0], pair[1], err))
+				}
+			}
+		}
+	}
+
+	if len(errs) != 0 {
+		return cli.NewMultiError(errs...)
+	}
+
+	return nil
+}
+
+func formatGroups(groups [][]int) string {
+	var out []string
+	for _, group := range groups {
+		var nodes []string
+		for _, n := range group {
+			nodes = append(nodes, strconv.Itoa(n))
+		}
+		out = append(out, "["+strings.Join(nodes, ",")+"]")
+	}
+
+	return strings.Join(out, " | ")
+}
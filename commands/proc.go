@@ -0,0 +1,155 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+
+	testbedi "github.com/ipfs/iptb/testbed/interfaces"
+	"github.com/ipfs/iptb/testbed/proc"
+)
+
+// metricsOf returns the metrics of a node. Nodes which implement Process also
+// report the resource usage of their process, read from /proc, even when they
+// do not implement Metric themselves.
+func metricsOf(node testbedi.Core) (testbedi.Metric, bool) {
+	metricNode, isMetric := node.(testbedi.Metric)
+
+	process, ok := node.(testbedi.Process)
+	if !ok {
+		return metricNode, isMetric
+	}
+
+	return &procMetrics{node: metricNode, process: process, root: proc.Root}, true
+}
+
+// procMetrics adds the /proc metrics of a process to the metrics of a node,
+// which may be nil
+type procMetrics struct {
+	node    testbedi.Metric
+	process testbedi.Process
+	root    string
+}
+
+func (p *procMetrics) stats() (proc.Stats, error) {
+	pid, err := p.process.PID()
+	if err != nil {
+		return proc.Stats{}, err
+	}
+
+	return proc.Read(p.root, pid)
+}
+
+func isProcMetric(key string) bool {
+	for _, m := range proc.Metrics {
+		if m.Name == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *procMetrics) Events() (io.ReadCloser, error) {
+	if p.node == nil {
+		return nil, fmt.Errorf("node does not implement metrics")
+	}
+
+	return p.node.Events()
+}
+
+func (p *procMetrics) StderrReader() (io.ReadCloser, error) {
+	if p.node == nil {
+		return nil, fmt.Errorf("node does not implement metrics")
+	}
+
+	return p.node.StderrReader()
+}
+
+func (p *procMetrics) StdoutReader() (io.ReadCloser, error) {
+	if p.node == nil {
+		return nil, fmt.Errorf("node does not implement metrics")
+	}
+
+	return p.node.StdoutReader()
+}
+
+// Heartbeat reports the heartbeat of the node along with the /proc metrics.
+// The node is unhealthy when its own heartbeat fails, or when it has no
+// heartbeat and its process can not be read.
+func (p *procMetrics) Heartbeat() (map[string]string, error) {
+	values := make(map[string]string)
+	if p.node != nil {
+		hb, err := p.node.Heartbeat()
+		if err != nil {
+			return hb, err
+		}
+
+		for k, v := range hb {
+			values[k] = v
+		}
+	}
+
+	stats, err := p.stats()
+	if err != nil {
+		if p.node == nil {
+			return nil, err
+		}
+
+		return values, nil
+	}
+
+	for k, v := range stats.Values() {
+		values[k] = v
+	}
+
+	return values, nil
+}
+
+func (p *procMetrics) Metric(key string) (string, error) {
+	if !isProcMetric(key) {
+		if p.node == nil {
+			return "", fmt.Errorf("unknown metric %s", key)
+		}
+
+		return p.node.Metric(key)
+	}
+
+	stats, err := p.stats()
+	if err != nil {
+		return "", err
+	}
+
+	return stats.Values()[key], nil
+}
+
+func (p *procMetrics) GetMetricList() []string {
+	var list []string
+	if p.node != nil {
+		for _, key := range p.node.GetMetricList() {
+			// The /proc metrics are read by iptb, even when the node lists them
+			if !isProcMetric(key) {
+				list = append(list, key)
+			}
+		}
+	}
+
+	for _, m := range proc.Metrics {
+		list = append(list, m.Name)
+	}
+
+	return list
+}
+
+func (p *procMetrics) GetMetricDesc(key string) (string, error) {
+	for _, m := range proc.Metrics {
+		if m.Name == key {
+			return m.Description, nil
+		}
+	}
+
+	if p.node == nil {
+		return "", fmt.Errorf("unknown metric %s", key)
+	}
+
+	return p.node.GetMetricDesc(key)
+}
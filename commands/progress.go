@@ -0,0 +1,196 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// progressTTYInterval is how often the progress line is redrawn on a
+	// terminal
+	progressTTYInterval = 250 * time.Millisecond
+	// progressLogInterval is how often a progress line is logged otherwise
+	progressLogInterval = 10 * time.Second
+	// progressSlowest is the number of slowest running nodes displayed
+	progressSlowest = 3
+)
+
+// progress reports how many nodes a command is done with. Reporting starts
+// with the first batch of nodes, and stops once every batch is released.
+type progress struct {
+	lk     sync.Mutex
+	w      io.Writer
+	label  string
+	tty    bool
+	active int
+	stop   chan struct{}
+	exited chan struct{}
+
+	begin    time.Time
+	total    int
+	finished int
+	failed   int
+	running  map[int]time.Time
+}
+
+func newProgress(w io.Writer, label string) *progress {
+	return &progress{
+		w:       w,
+		label:   label,
+		tty:     isTerminal(w),
+		running: make(map[int]time.Time),
+	}
+}
+
+func isTerminal(w io.Writer) bool {
+	fi, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+
+	st, err := fi.Stat()
+	if err != nil {
+		return false
+	}
+
+	return st.Mode()&os.ModeCharDevice != 0
+}
+
+// add registers a batch of n nodes, and starts reporting if needed
+func (p *progress) add(n int) {
+	if p == nil {
+		return
+	}
+
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	p.total += n
+	p.active++
+	if p.active == 1 {
+		p.begin = time.Now()
+		p.stop = make(chan struct{})
+		p.exited = make(chan struct{})
+		go p.report(p.stop, p.exited)
+	}
+}
+
+// release marks a batch as done, and stops reporting after the last one
+func (p *progress) release() {
+	if p == nil {
+		return
+	}
+
+	p.lk.Lock()
+	p.active--
+	last := p.active == 0
+	stop, exited := p.stop, p.exited
+	p.lk.Unlock()
+
+	if last {
+		close(stop)
+		<-exited
+	}
+}
+
+func (p *progress) start(n int) {
+	if p == nil {
+		return
+	}
+
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	p.running[n] = time.Now()
+}
+
+func (p *progress) finish(n int, failed bool) {
+	if p == nil {
+		return
+	}
+
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	delete(p.running, n)
+	p.finished++
+	if failed {
+		p.failed++
+	}
+}
+
+func (p *progress) report(stop, exited chan struct{}) {
+	defer close(exited)
+
+	interval := progressLogInterval
+	if p.tty {
+		interval = progressTTYInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	drawn := false
+	for {
+		select {
+		case <-ticker.C:
+			line := p.line()
+			if p.tty {
+				fmt.Fprintf(p.w, "\r\x1b[K%s", line)
+			} else {
+				fmt.Fprintf(p.w, "%s\n", line)
+			}
+			drawn = true
+		case <-stop:
+			if p.tty && drawn {
+				fmt.Fprint(p.w, "\r\x1b[K")
+			}
+			return
+		}
+	}
+}
+
+// line formats the current progress, e.g.
+// start: 12/100 done, 1 failed, eta 30s, slowest node[3] 12s node[7] 10s
+func (p *progress) line() string {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	now := time.Now()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %d/%d done, %d failed", p.label, p.finished, p.total, p.failed)
+
+	if p.finished != 0 {
+		elapsed := now.Sub(p.begin)
+		eta := elapsed * time.Duration(p.total-p.finished) / time.Duration(p.finished)
+		fmt.Fprintf(&b, ", eta %s", eta.Round(time.Second))
+	}
+
+	var nodes []int
+	for n := range p.running {
+		nodes = append(nodes, n)
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return p.running[nodes[i]].Before(p.running[nodes[j]])
+	})
+
+	if len(nodes) > progressSlowest {
+		nodes = nodes[:progressSlowest]
+	}
+
+	if len(nodes) != 0 {
+		b.WriteString(", slowest")
+		for _, n := range nodes {
+			fmt.Fprintf(&b, " node[%d] %s", n, now.Sub(p.running[n]).Round(time.Second))
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,50 @@
+package commands
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestProgressLine(t *testing.T) {
+	p := newProgress(&bytes.Buffer{}, "start")
+	p.total = 6
+
+	now := time.Now()
+	p.begin = now.Add(-10 * time.Second)
+	for n, age := range []time.Duration{2, 7, 5, 3, 1} {
+		p.running[n] = now.Add(-age * time.Second)
+	}
+
+	p.finish(0, false)
+	p.finish(4, true)
+
+	// Two nodes done in 10s, four left, the slowest started first
+	expect(t, p.line(), "start: 2/6 done, 1 failed, eta 20s, slowest node[1] 7s node[2] 5s node[3] 3s")
+}
+
+func TestProgressReport(t *testing.T) {
+	var buf bytes.Buffer
+	p := newProgress(&buf, "init")
+
+	// Writers which are not terminals get no progress until the first log
+	// interval, and releasing the last batch stops reporting
+	p.add(2)
+	p.add(1)
+	p.start(0)
+	p.finish(0, false)
+	p.release()
+	p.release()
+
+	expect(t, p.tty, false)
+	expect(t, p.total, 3)
+	expect(t, p.finished, 1)
+	expect(t, buf.String(), "")
+
+	// Nodes of commands which do not report progress are ignored
+	var none *progress
+	none.add(1)
+	none.start(0)
+	none.finish(0, true)
+	none.release()
+}
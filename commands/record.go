@@ -0,0 +1,347 @@
+package commands
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cli "github.com/urfave/cli"
+
+	"github.com/ipfs/iptb/testbed"
+	testbedi "github.com/ipfs/iptb/testbed/interfaces"
+)
+
+var MetricRecordCmd = cli.Command{
+	Name:      "record",
+	Usage:     "sample metrics of specified nodes (or all) over time",
+	ArgsUsage: "[nodes]",
+	Description: `
+The record command samples metrics of every node each --interval, and writes
+one row per node and metric with the time of the sample, until iptb is
+interrupted or --duration elapsed:
+
+$ iptb metric record --interval 1s --metrics cpu,bwin,bwout --out run.csv [0-9]
+$ head -3 run.csv
+time,node,metric,value,error
+2024-05-01T14:02:11.000Z,0,cpu,12.5,
+2024-05-01T14:02:11.000Z,0,bwin,1024,
+
+Without --metrics, the heartbeat of every node is recorded.
+
+Samples are taken on a fixed schedule, and stamped with the time they were
+scheduled at. A node still busy with a sample when the next one is due skips
+it, so slow nodes neither delay nor shift the samples of the others.
+
+Rows are written as csv, or as ndjson when --out ends with .ndjson or .jsonl,
+or with --format ndjson.
+`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "interval",
+			Usage: "delay between two samples",
+			Value: "1s",
+		},
+		cli.StringFlag{
+			Name:  "metrics",
+			Usage: "comma separated metrics to record, the heartbeat when empty",
+		},
+		cli.StringFlag{
+			Name:  "out",
+			Usage: "file the samples are written to, stdout when empty",
+		},
+		cli.StringFlag{
+			Name:  "duration",
+			Usage: "stop recording after this duration, e.g. 10m",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		flagRoot := c.GlobalString("IPTB_ROOT")
+		flagTestbed := c.GlobalString("testbed")
+		flagQuiet := c.GlobalBool("quiet")
+		flagFormat := c.GlobalString("format")
+		flagInterval := c.String("interval")
+		flagMetrics := c.String("metrics")
+		flagOut := c.String("out")
+
+		interval, err := time.ParseDuration(flagInterval)
+		if err != nil || interval <= 0 {
+			return NewUsageError(fmt.Sprintf("invalid interval %s", flagInterval))
+		}
+
+		duration, err := ParseTimeout(c.String("duration"))
+		if err != nil {
+			return err
+		}
+
+		var metrics []string
+		if flagMetrics != "" {
+			metrics = strings.Split(flagMetrics, ",")
+		}
+
+		tb := testbed.NewTestbed(path.Join(flagRoot, "testbeds", flagTestbed))
+		nodes, err := tb.Nodes()
+		if err != nil {
+			return err
+		}
+
+		nodeRange := c.Args().First()
+
+		if nodeRange == "" {
+			nodeRange = fmt.Sprintf("[0-%d]", len(nodes)-1)
+		}
+
+		list, err := parseRange(nodeRange)
+		if err != nil {
+			return fmt.Errorf("could not parse node range %s", nodeRange)
+		}
+
+		if err := validRange(list, len(nodes)); err != nil {
+			return err
+		}
+
+		metricNodes := make(map[int]testbedi.Metric)
+		for _, n := range list {
+			metricNode, ok := metricsOf(nodes[n])
+			if !ok {
+				return fmt.Errorf("node[%d]: node does not implement metrics", n)
+			}
+
+			metricNodes[n] = metricNode
+		}
+
+		var w io.Writer = c.App.Writer
+		if flagOut != "" {
+			fi, err := os.Create(flagOut)
+			if err != nil {
+				return err
+			}
+
+			defer fi.Close()
+			w = fi
+		}
+
+		ext := filepath.Ext(flagOut)
+		ndjson := ext == ".ndjson" || ext == ".jsonl" || (ext == "" && flagFormat == formatNDJSON)
+
+		sink := newSampleWriter(w, ndjson)
+
+		ctx := rootContext(c)
+		if duration > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, duration)
+			defer cancel()
+		}
+
+		skipped := recordMetrics(ctx, list, metricNodes, metrics, interval, sink)
+
+		if err := sink.close(); err != nil {
+			return err
+		}
+
+		if !flagQuiet {
+			fmt.Fprintf(c.App.ErrWriter, "recorded %d samples, %d skipped\n", sink.count(), skipped)
+		}
+
+		return nil
+	},
+}
+
+// metricSample is the value of a metric of a node at a given time
+type metricSample struct {
+	Time   time.Time    `json:"time"`
+	Node   int          `json:"node"`
+	Metric string       `json:"metric"`
+	Value  string       `json:"value"`
+	Error  *ErrorRecord `json:"error"`
+}
+
+// recordMetrics samples nodes every interval until ctx is done, and returns
+// how many samples were skipped because a node was still busy.
+func recordMetrics(ctx context.Context, list []int, nodes map[int]testbedi.Metric, metrics []string, interval time.Duration, sink *sampleWriter) int {
+	var wg sync.WaitGroup
+	skipped := 0
+
+	// Every node is fed the times of the samples it is due for, unless it is
+	// still busy with the previous one
+	due := make(map[int]chan time.Time)
+	busy := make(map[int]*atomic.Bool)
+	for _, n := range list {
+		due[n] = make(chan time.Time, 1)
+		busy[n] = new(atomic.Bool)
+
+		wg.Add(1)
+		go func(n int, node testbedi.Metric, due chan time.Time, busy *atomic.Bool) {
+			defer wg.Done()
+
+			for {
+				select {
+				case t := <-due:
+					samples, ok := sampleNode(ctx, n, node, metrics, t)
+					if !ok {
+						return
+					}
+
+					sink.write(samples)
+					busy.Store(false)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(n, nodes[n], due[n], busy[n])
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	start := time.Now()
+	for k := 0; ; k++ {
+		t := start.Add(time.Duration(k) * interval)
+		for _, n := range list {
+			if busy[n].Swap(true) {
+				skipped++
+				continue
+			}
+
+			due[n] <- t
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			wg.Wait()
+			return skipped
+		}
+	}
+}
+
+// sampleNode reads the metrics of a node, or its heartbeat when metrics is
+// empty. It returns false when ctx is done first, as Metric and Heartbeat
+// can not be cancelled.
+func sampleNode(ctx context.Context, n int, node testbedi.Metric, metrics []string, t time.Time) ([]metricSample, bool) {
+	done := make(chan []metricSample, 1)
+	go func() {
+		var samples []metricSample
+
+		if len(metrics) == 0 {
+			values, err := node.Heartbeat()
+			if err != nil {
+				samples = append(samples, metricSample{Time: t, Node: n, Metric: "heartbeat", Error: NewErrorRecord(err)})
+			}
+
+			keys := make([]string, 0, len(values))
+			for key := range values {
+				keys = append(keys, key)
+			}
+
+			sort.Strings(keys)
+
+			for _, key := range keys {
+				samples = append(samples, metricSample{Time: t, Node: n, Metric: key, Value: values[key]})
+			}
+
+			done <- samples
+			return
+		}
+
+		for _, key := range metrics {
+			value, err := node.Metric(key)
+			samples = append(samples, metricSample{Time: t, Node: n, Metric: key, Value: value, Error: NewErrorRecord(err)})
+		}
+
+		done <- samples
+	}()
+
+	select {
+	case samples := <-done:
+		return samples, true
+	case <-ctx.Done():
+		return nil, false
+	}
+}
+
+// sampleWriter writes samples as csv or ndjson, from many nodes at once
+type sampleWriter struct {
+	lk      sync.Mutex
+	csv     *csv.Writer
+	json    *json.Encoder
+	written int
+	err     error
+}
+
+func newSampleWriter(w io.Writer, ndjson bool) *sampleWriter {
+	if ndjson {
+		return &sampleWriter{json: json.NewEncoder(w)}
+	}
+
+	s := &sampleWriter{csv: csv.NewWriter(w)}
+	s.err = s.csv.Write([]string{"time", "node", "metric", "value", "error"})
+	return s
+}
+
+func (s *sampleWriter) write(samples []metricSample) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	for _, sample := range samples {
+		if s.err != nil {
+			return
+		}
+
+		s.written++
+
+		if s.json != nil {
+			s.err = s.json.Encode(sample)
+			continue
+		}
+
+		msg := ""
+		if sample.Error != nil {
+			msg = sample.Error.Message
+		}
+
+		s.err = s.csv.Write([]string{
+			sample.Time.UTC().Format(time.RFC3339Nano),
+			strconv.Itoa(sample.Node),
+			sample.Metric,
+			sample.Value,
+			msg,
+		})
+	}
+
+	// Rows are flushed as they come, so a recording can be followed
+	if s.csv != nil && s.err == nil {
+		s.csv.Flush()
+		s.err = s.csv.Error()
+	}
+}
+
+func (s *sampleWriter) count() int {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	return s.written
+}
+
+// close flushes the samples left, and returns the first error met
+func (s *sampleWriter) close() error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	if s.csv != nil && s.err == nil {
+		s.csv.Flush()
+		s.err = s.csv.Error()
+	}
+
+	return s.err
+}
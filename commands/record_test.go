@@ -0,0 +1,26 @@
+package commands
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSampleWriter(t *testing.T) {
+	at := time.Date(2024, 5, 1, 14, 2, 11, 0, time.UTC)
+
+	var buf bytes.Buffer
+	s := newSampleWriter(&buf, false)
+	s.write([]metricSample{
+		{Time: at, Node: 0, Metric: "cpu", Value: "12.5"},
+		{Time: at, Node: 1, Metric: "cpu", Error: NewErrorRecord(errors.New("no cpu, sorry"))},
+	})
+
+	expect(t, s.close(), nil)
+	expect(t, s.count(), 2)
+	expect(t, buf.String(), ""+
+		"time,node,metric,value,error\n"+
+		"2024-05-01T14:02:11Z,0,cpu,12.5,\n"+
+		"2024-05-01T14:02:11Z,1,cpu,,\"no cpu, sorry\"\n")
+}
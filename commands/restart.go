@@ -9,6 +9,7 @@ import (
 
 	"github.com/ipfs/iptb/testbed"
 	testbedi "github.com/ipfs/iptb/testbed/interfaces"
+	"github.com/ipfs/iptb/testbed/netns"
 )
 
 var RestartCmd = cli.Command{
@@ -17,9 +18,18 @@ var RestartCmd = cli.Command{
 	Usage:     "restart specified nodes (or all)",
 	ArgsUsage: "[nodes] -- [arguments...]",
 	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "timeout",
+			Usage: "maximum duration of the command on every node, e.g. 30s",
+		},
 		cli.BoolFlag{
 			Name:  "wait",
-			Usage: "wait for nodes to start before returning",
+			Usage: "wait for nodes to be ready before returning",
+		},
+		cli.StringFlag{
+			Name:  "wait-timeout",
+			Usage: "maximum duration of the wait for every node to be ready",
+			Value: "60s",
 		},
 		cli.BoolFlag{
 			Name:   "terminator",
@@ -37,7 +47,15 @@ var RestartCmd = cli.Command{
 		flagRoot := c.GlobalString("IPTB_ROOT")
 		flagTestbed := c.GlobalString("testbed")
 		flagQuiet := c.GlobalBool("quiet")
+		flagFormat := c.GlobalString("format")
+		flagAllowFailures := c.GlobalInt("allow-failures")
 		flagWait := c.Bool("wait")
+		flagWaitTimeout := c.String("wait-timeout")
+
+		waitTimeout, err := ParseTimeout(flagWaitTimeout)
+		if err != nil {
+			return err
+		}
 
 		tb := testbed.NewTestbed(path.Join(flagRoot, "testbeds", flagTestbed))
 		nodes, err := tb.Nodes()
@@ -56,19 +74,45 @@ var RestartCmd = cli.Command{
 			return fmt.Errorf("could not parse node range %s", nodeRange)
 		}
 
-		runCmd := func(node testbedi.Core) (testbedi.Output, error) {
-			if err := node.Stop(context.Background()); err != nil {
+		r := newReadiness(readyInterval, waitTimeout)
+
+		runCmd := func(ctx context.Context, n int, node testbedi.Core) (testbedi.Output, error) {
+			if err := node.Stop(ctx); err != nil {
 				return nil, err
 			}
 
-			return node.Start(context.Background(), flagWait, args...)
+			return r.start(ctx, n, node, flagWait, args)
+		}
+
+		nw, err := netns.Load(tb.Dir())
+		if err != nil {
+			return err
+		}
+
+		m, err := newMapper(c)
+		if err != nil {
+			return err
 		}
 
-		results, err := mapWithOutput(list, nodes, runCmd)
+		results, err := m.mapWithOutput(list, nodes, inNetns(nw, runCmd))
 		if err != nil {
 			return err
 		}
 
-		return buildReport(results, flagQuiet)
+		r.record(results)
+
+		// Filters do not survive a restart, they are restored on every node
+		// which started, even when others failed
+		perr := enforcePartitions(rootContext(c), tb, nodes, succeeded(results))
+
+		if err := buildReport(results, flagQuiet, flagFormat, flagAllowFailures); err != nil {
+			if perr != nil {
+				return cli.NewMultiError(err, perr)
+			}
+
+			return err
+		}
+
+		return perr
 	},
 }
@@ -14,7 +14,7 @@ import (
 
 	"github.com/ipfs/iptb/testbed"
 	testbedi "github.com/ipfs/iptb/testbed/interfaces"
-	"github.com/mattn/go-shellwords"
+	"github.com/ipfs/iptb/testbed/netns"
 )
 
 var RunCmd = cli.Command{
@@ -52,11 +52,145 @@ $ iptb run <<CMDS
           -- echo "Running on all nodes"
   CMDS
 
-Note that any single call to ` + "`iptb run`" + ` runs *all* commands concurrently. So,
-in the above example, there is no guarantee as to the order in which the lines
-are printed.
+Note that by default any single call to ` + "`iptb run`" + ` runs *all* commands
+concurrently. So, in the above example, there is no guarantee as to the order
+in which the lines are printed.
+
+Scripts can be split into stages by lines holding '---'. A stage only starts
+once every command of the previous stage exited. A line holding 'wait' waits
+for every command started before it in the stage:
+
+$ iptb run <<CMDS
+    -- ipfs add -q file
+    ---
+    [1-4] -- ipfs get <cid>
+  CMDS
+
+With --sequential, every command is run once the previous one exited, unless
+the line ends with '&', which runs the command in the background like a shell:
+
+$ iptb run --sequential <<CMDS
+    0 -- ipfs add -q a &
+    1 -- ipfs add -q b &
+    wait
+    [0-1] -- ipfs repo stat
+  CMDS
+
+With --stop-on-failure, once a command failed or exited with a non-zero code,
+the commands following the next barrier (the end of a stage, a 'wait', or any
+command run with --sequential) are not run.
+
+With --stream, output is printed as it is produced rather than once commands
+exit. Every line is prefixed with the node it came from, and each node ends
+with its exit code:
+
+$ iptb run --stream --timestamps -- ipfs log tail
+14:02:11.532 [node 0] {"event":"..."}
+14:02:11.540 [node 1] {"event":"..."}
+
+With --format ndjson, every line is printed as a json object instead.
+
+Commands are run without input, unless --stdin-file or --stdin-fanout is used.
+The path given to --stdin-file is a template, expanded with the index of every
+node, so nodes can be fed the same file or a file each:
+
+$ iptb run --stdin-file data.bin -- ipfs add -q
+$ iptb run --stdin-file 'inputs/{{.Index}}.dat' -- ipfs add -q
+
+With --stdin-fanout, the stdin of iptb is copied to the command of every node.
+As stdin then carries input rather than commands, the command must be passed
+as arguments:
+
+$ tar c dir | iptb run --stdin-fanout [0-3] -- ipfs add -q
+
+Arguments are go templates, expanded for every node the command runs on. The
+node is available as '.', with the fields and methods Index, PeerID, APIAddr,
+SwarmAddrs, Dir, Type and Attr. The following functions are also available:
+
+  node <n>          the node n of the testbed
+  attr <name>       the attribute name of the node
+  first <list>      the first element of a list
+  join <list> <sep> the elements of a list, separated by sep
+
+$ iptb run 0 -- ipfs swarm connect '{{(node 5).SwarmAddrs | first}}'
+$ iptb run -- ipfs get '{{attr "cid"}}'
+$ iptb run -- echo '{{.Index}} is {{.PeerID}}'
+
+Use --no-template to pass arguments containing '{{' as is.
+
+The output of commands can be checked on every node, failing the nodes which
+do not meet the expectations:
+
+  --expect-exit <code>        the command exits with code
+  --expect-stdout <regex>     stdout matches regex
+  --expect-stderr-empty       nothing is printed on stderr
+  --expect-same-output        every node prints the same stdout
+  --expect-json <path=value>  stdout is json, holding value at path
+
+$ iptb run --expect-json '.Addresses[0]="/ip4/127.0.0.1/tcp/4001"' -- ipfs id
+$ iptb run --expect-same-output -- ipfs cat <cid>
+
+Failures name every expectation a node broke, along with an excerpt of its
+output. In a script, outputs are only compared between the nodes which ran the
+same line. With --stream, only --expect-exit can be used.
 `,
 	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "timeout",
+			Usage: "maximum duration of the command on every node, e.g. 30s",
+		},
+		cli.BoolFlag{
+			Name:  "stream",
+			Usage: "print output line by line, as it is produced",
+		},
+		cli.BoolFlag{
+			Name:  "color",
+			Usage: "color the node prefix of streamed output",
+		},
+		cli.BoolFlag{
+			Name:  "timestamps",
+			Usage: "prefix streamed output with the time it was received",
+		},
+		cli.StringFlag{
+			Name:  "stdin-file",
+			Usage: "file passed as stdin to every command, may use {{.Index}}",
+		},
+		cli.BoolFlag{
+			Name:  "stdin-fanout",
+			Usage: "copy stdin to the command of every node",
+		},
+		cli.BoolFlag{
+			Name:  "sequential",
+			Usage: "run the commands of a script one after the other",
+		},
+		cli.BoolFlag{
+			Name:  "stop-on-failure",
+			Usage: "do not run commands after a barrier once a command failed",
+		},
+		cli.BoolFlag{
+			Name:  "no-template",
+			Usage: "pass arguments as is, without expanding templates",
+		},
+		cli.IntFlag{
+			Name:  "expect-exit",
+			Usage: "fail nodes whose command does not exit with this code",
+		},
+		cli.StringFlag{
+			Name:  "expect-stdout",
+			Usage: "fail nodes whose stdout does not match this regex",
+		},
+		cli.BoolFlag{
+			Name:  "expect-stderr-empty",
+			Usage: "fail nodes which print on stderr",
+		},
+		cli.BoolFlag{
+			Name:  "expect-same-output",
+			Usage: "fail nodes whose stdout differs from most nodes running the same command",
+		},
+		cli.StringSliceFlag{
+			Name:  "expect-json",
+			Usage: "fail nodes whose stdout does not hold value at a json path, e.g. .ID=\"Qm...\"",
+		},
 		cli.BoolFlag{
 			Name:   "terminator",
 			Hidden: true,
@@ -67,7 +201,13 @@ are printed.
 		},
 	},
 	Before: func(c *cli.Context) error {
+		if c.Bool("stdin-fanout") && c.IsSet("stdin-file") {
+			return NewUsageError("--stdin-fanout and --stdin-file can not be used together")
+		}
 		if c.NArg() == 0 {
+			if c.Bool("stdin-fanout") {
+				return NewUsageError("--stdin-fanout requires the command as arguments")
+			}
 			finfo, err := os.Stdin.Stat()
 			if err != nil {
 				return err
@@ -86,6 +226,29 @@ are printed.
 		flagRoot := c.GlobalString("IPTB_ROOT")
 		flagTestbed := c.GlobalString("testbed")
 		flagQuiet := c.GlobalBool("quiet")
+		flagFormat := c.GlobalString("format")
+		flagAllowFailures := c.GlobalInt("allow-failures")
+		flagStream := c.Bool("stream")
+		flagStdinFile := c.String("stdin-file")
+		flagStdinFanout := c.Bool("stdin-fanout")
+		flagNoTemplate := c.Bool("no-template")
+
+		if flagStream && flagFormat == formatJSON {
+			return NewUsageError("--stream can not be used with --format json, use ndjson")
+		}
+
+		stream := &streamer{
+			stdout:     os.Stdout,
+			stderr:     os.Stderr,
+			format:     flagFormat,
+			color:      c.Bool("color"),
+			timestamps: c.Bool("timestamps"),
+		}
+
+		expect, err := newExpectation(c)
+		if err != nil {
+			return err
+		}
 
 		tb := testbed.NewTestbed(path.Join(flagRoot, "testbeds", flagTestbed))
 		nodes, err := tb.Nodes()
@@ -110,44 +273,181 @@ are printed.
 			reader = strings.NewReader(builder.String())
 		}
 
-		var args [][]string
-		scanner := bufio.NewScanner(reader)
-		line := 1
-		for scanner.Scan() {
-			tokens, err := shellwords.Parse(scanner.Text())
-			if err != nil {
-				return fmt.Errorf("parse error on line %d: %s", line, err)
-			}
-			if strings.HasPrefix(tokens[0], "#") {
-				continue
-			}
-			args = append(args, tokens)
-			line++
+		script, err := parseScript(reader)
+		if err != nil {
+			return err
 		}
 
-		ranges := make([][]int, len(args))
-		runCmds := make([]outputFunc, len(args))
-		for i, cmd := range args {
-			nodeRange, tokens := parseCommand(cmd, false)
-			if nodeRange == "" {
-				nodeRange = fmt.Sprintf("[0-%d]", len(nodes)-1)
+		templates, err := newNodeTemplates(tb)
+		if err != nil {
+			return err
+		}
+
+		var input *stdinSource
+		if flagStdinFile != "" {
+			input = newStdinFile(flagStdinFile, templates)
+		}
+
+		nw, err := netns.Load(tb.Dir())
+		if err != nil {
+			return err
+		}
+
+		stages := make([][]scriptCommand, len(script))
+		for i, stage := range script {
+			for _, line := range stage {
+				cmd := scriptCommand{scriptLine: line}
+				stages[i] = append(stages[i], cmd)
+				if line.Wait {
+					continue
+				}
+
+				nodeRange, tokens := parseCommand(line.Args, false)
+				if nodeRange == "" {
+					nodeRange = fmt.Sprintf("[0-%d]", len(nodes)-1)
+				}
+				list, err := parseRange(nodeRange)
+				if err != nil {
+					return fmt.Errorf("could not parse node range %s on line %d", nodeRange, line.Line)
+				}
+
+				if err := validRange(list, len(nodes)); err != nil {
+					return fmt.Errorf("line %d: %w", line.Line, err)
+				}
+
+				runCmd := func(ctx context.Context, n int, node testbedi.Core) (testbedi.Output, error) {
+					stdin, done, err := input.open(n)
+					if err != nil {
+						return nil, err
+					}
+
+					defer done()
+
+					args := tokens
+					if !flagNoTemplate {
+						args, err = templates.expandAll(n, tokens)
+						if err != nil {
+							return nil, err
+						}
+					}
+
+					var out testbedi.Output
+					if flagStream {
+						out, err = stream.run(ctx, n, node, stdin, args)
+					} else {
+						out, err = node.RunCmd(ctx, stdin, args...)
+					}
+
+					if err != nil || expect == nil {
+						return out, err
+					}
+
+					return expect.check(out)
+				}
+
+				stages[i][len(stages[i])-1].List = list
+				stages[i][len(stages[i])-1].Fn = inNetns(nw, runCmd)
 			}
-			list, err := parseRange(nodeRange)
+		}
+
+		if flagStdinFanout {
+			input, err = newStdinFanout(os.Stdin, stages[0][0].List)
 			if err != nil {
-				return fmt.Errorf("could not parse node range %s", nodeRange)
+				return err
 			}
-			ranges[i] = list
 
-			runCmd := func(node testbedi.Core) (testbedi.Output, error) {
-				return node.RunCmd(context.Background(), nil, tokens...)
-			}
-			runCmds[i] = runCmd
+			defer input.close()
 		}
 
-		results, err := mapListWithOutput(ranges, nodes, runCmds)
+		// Progress would be interleaved with the streamed output
+		m, err := newMapper(c)
 		if err != nil {
 			return err
 		}
-		return buildReport(results, flagQuiet)
+
+		if flagStream {
+			m.progress = nil
+		}
+
+		runner := &scriptRunner{
+			nodes:         nodes,
+			mapper:        m,
+			Sequential:    c.Bool("sequential"),
+			StopOnFailure: c.Bool("stop-on-failure"),
+		}
+
+		byCommand, skipped, err := runner.run(stages)
+		if err != nil {
+			return err
+		}
+
+		// Outputs are only compared between the nodes which ran the same command
+		var results []Result
+		for _, rs := range byCommand {
+			if c.Bool("expect-same-output") {
+				checkSameOutput(rs)
+			}
+
+			results = append(results, rs...)
+		}
+
+		if flagStream {
+			err = stream.report(results, flagQuiet, flagAllowFailures)
+		} else {
+			err = buildReport(results, flagQuiet, flagFormat, flagAllowFailures)
+		}
+
+		if skipped != 0 && !flagQuiet {
+			fmt.Fprintf(c.App.ErrWriter, "stopped after a failure, %d commands not run\n", skipped)
+		}
+
+		return err
 	},
 }
+
+// newExpectation returns the expectation set by the flags of run, or nil when
+// none is set
+func newExpectation(c *cli.Context) (*expectation, error) {
+	flagExpectStdout := c.String("expect-stdout")
+	flagExpectJSON := c.StringSlice("expect-json")
+
+	outputSet := flagExpectStdout != "" || len(flagExpectJSON) != 0 ||
+		c.Bool("expect-stderr-empty") || c.Bool("expect-same-output")
+
+	if !outputSet && !c.IsSet("expect-exit") {
+		return nil, nil
+	}
+
+	if outputSet && c.Bool("stream") {
+		return nil, NewUsageError("--stream can only be used with --expect-exit")
+	}
+
+	e := &expectation{
+		StderrEmpty: c.Bool("expect-stderr-empty"),
+	}
+
+	if c.IsSet("expect-exit") {
+		exit := c.Int("expect-exit")
+		e.Exit = &exit
+	}
+
+	if flagExpectStdout != "" {
+		re, err := compileOutputRegexp(flagExpectStdout)
+		if err != nil {
+			return nil, NewUsageError(fmt.Sprintf("invalid --expect-stdout: %s", err))
+		}
+
+		e.Stdout = re
+	}
+
+	for _, s := range flagExpectJSON {
+		je, err := parseJSONExpectation(s)
+		if err != nil {
+			return nil, NewUsageError(err.Error())
+		}
+
+		e.JSON = append(e.JSON, je)
+	}
+
+	return e, nil
+}
@@ -0,0 +1,956 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-shellwords"
+	cli "github.com/urfave/cli"
+	"gopkg.in/yaml.v3"
+
+	"github.com/ipfs/iptb/testbed"
+	testbedi "github.com/ipfs/iptb/testbed/interfaces"
+	"github.com/ipfs/iptb/testbed/netns"
+)
+
+var ScenarioCmd = cli.Command{
+	Category: "TESTING",
+	Name:     "scenario",
+	Usage:    "run multi-step experiments described in yaml",
+	Subcommands: []cli.Command{
+		ScenarioRunCmd,
+	},
+}
+
+var ScenarioRunCmd = cli.Command{
+	Name:      "run",
+	Usage:     "run the steps of a scenario",
+	ArgsUsage: "<file.yaml>",
+	Description: `
+A scenario is a sequence of steps run against a testbed. Every step holds one
+action, given as a key whose value is the argument of the action:
+
+  create: <count>      create a testbed of count nodes, using type and attrs
+  init: [args]         initialize nodes
+  start: [args]        start nodes, waiting for them with ready: true
+  kill:                stop nodes
+  restart: [args]      restart nodes, waiting for them with ready: true
+  connect: [topology]  connect nodes following a topology (see connect)
+  run: <command>       run a command, keeping its output with capture: <name>
+  wait: <command>      run a command until it exits with exit (default 0) and
+                       its stdout matches stdout, within timeout (default 60s)
+  assert: <command>    run a command and check its exit code and stdout
+  collect: [command]   write the output of a command, or the logs of nodes
+                       without command, to files in out
+  sleep: <duration>    pause the scenario
+  loop: <count>        run steps count times
+
+Steps act on every node, unless nodes selects a range, e.g. nodes: [0-3].
+Commands are expanded as templates like with run. The output captured on a
+node is available with {{var "<name>.<node>"}}, or with {{var "<name>"}} for
+the first node which printed output. Variables of the scenario can be set with
+vars, and the iteration of a loop is available with {{var "i"}}, which is the
+iteration of the innermost loop within nested loops, and is restored once a
+loop ends.
+
+  name: fetch
+  testbed: fetch
+  vars:
+    file: /tmp/data
+  steps:
+    - create: 4
+      type: localipfs
+      force: true
+    - init:
+    - start:
+      ready: true
+    - connect: star:0
+    - run: ipfs add -q {{var "file"}}
+      nodes: [0]
+      capture: cid
+    - loop: 3
+      steps:
+        - assert: ipfs cat {{var "cid"}}
+          nodes: [1-3]
+          stdout: .+
+        - sleep: 1s
+
+A line is printed for every step, or a record with --format json and ndjson.
+Failed assertions are reported without stopping the scenario, which exits with
+an error once done. Any other failed step stops the scenario.
+`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "report",
+			Usage: "write a json report of every step to a file",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		flagRoot := c.GlobalString("IPTB_ROOT")
+		flagTestbed := c.GlobalString("testbed")
+		flagQuiet := c.GlobalBool("quiet")
+		flagFormat := c.GlobalString("format")
+		flagReport := c.String("report")
+
+		if c.NArg() != 1 {
+			return NewUsageError("scenario run takes exactly 1 argument")
+		}
+
+		sc, err := readScenario(c.Args().First())
+		if err != nil {
+			return err
+		}
+
+		if sc.Testbed != "" {
+			flagTestbed = sc.Testbed
+		}
+
+		r := &scenarioRunner{
+			c:      c,
+			ctx:    rootContext(c),
+			dir:    path.Join(flagRoot, "testbeds", flagTestbed),
+			vars:   make(map[string]string),
+			w:      c.App.Writer,
+			format: flagFormat,
+			quiet:  flagQuiet,
+		}
+
+		for k, v := range sc.Vars {
+			r.vars[k] = v
+		}
+
+		err = r.runSteps("", sc.Steps)
+
+		if flagFormat == formatJSON {
+			if werr := writeFormatted(c.App.Writer, flagFormat, r.records, nil); werr != nil {
+				return werr
+			}
+		}
+
+		if flagReport != "" {
+			if werr := writeScenarioReport(flagReport, r.records); werr != nil {
+				return werr
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if r.failed != 0 {
+			return fmt.Errorf("%d assertions failed", r.failed)
+		}
+
+		return nil
+	},
+}
+
+// scenario is an experiment run by `iptb scenario run`
+type scenario struct {
+	Name    string            `yaml:"name"`
+	Testbed string            `yaml:"testbed"`
+	Vars    map[string]string `yaml:"vars"`
+	Steps   []*scenarioStep   `yaml:"steps"`
+}
+
+// scenarioActions are the keys which give the action of a step
+var scenarioActions = map[string]bool{
+	"create":  true,
+	"init":    true,
+	"start":   true,
+	"kill":    true,
+	"restart": true,
+	"connect": true,
+	"run":     true,
+	"wait":    true,
+	"assert":  true,
+	"collect": true,
+	"sleep":   true,
+	"loop":    true,
+}
+
+// scenarioFields are the other keys a step may hold
+var scenarioFields = map[string]bool{
+	"name":     true,
+	"nodes":    true,
+	"type":     true,
+	"attrs":    true,
+	"force":    true,
+	"ready":    true,
+	"capture":  true,
+	"exit":     true,
+	"stdout":   true,
+	"timeout":  true,
+	"interval": true,
+	"out":      true,
+	"seed":     true,
+	"steps":    true,
+}
+
+// scenarioStep is a single step of a scenario
+type scenarioStep struct {
+	// Action is the key of the step naming its action, and Args its value
+	Action string   `yaml:"-"`
+	Args   []string `yaml:"-"`
+	// Line is the line of the step in the scenario file
+	Line int `yaml:"-"`
+
+	Name     string            `yaml:"name"`
+	Nodes    nodeSelector      `yaml:"nodes"`
+	Type     string            `yaml:"type"`
+	Attrs    map[string]string `yaml:"attrs"`
+	Force    bool              `yaml:"force"`
+	Ready    bool              `yaml:"ready"`
+	Capture  string            `yaml:"capture"`
+	Exit     *int              `yaml:"exit"`
+	Stdout   string            `yaml:"stdout"`
+	Timeout  string            `yaml:"timeout"`
+	Interval string            `yaml:"interval"`
+	Out      string            `yaml:"out"`
+	Seed     *int64            `yaml:"seed"`
+	Steps    []*scenarioStep   `yaml:"steps"`
+}
+
+func (s *scenarioStep) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: a step must be a mapping", node.Line)
+	}
+
+	type plain scenarioStep
+	if err := node.Decode((*plain)(s)); err != nil {
+		return err
+	}
+
+	s.Line = node.Line
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, val := node.Content[i], node.Content[i+1]
+
+		if key.Value == "wait" && val.Tag == "!!bool" {
+			return fmt.Errorf("line %d: wait is an action, nodes are waited for with ready: %s", key.Line, val.Value)
+		}
+
+		if !scenarioActions[key.Value] {
+			if !scenarioFields[key.Value] {
+				return fmt.Errorf("line %d: unknown key %s", key.Line, key.Value)
+			}
+			continue
+		}
+
+		if s.Action != "" {
+			return fmt.Errorf("line %d: step has both %s and %s", key.Line, s.Action, key.Value)
+		}
+
+		s.Action = key.Value
+
+		switch val.Kind {
+		case yaml.ScalarNode:
+			if val.Tag == "!!null" || val.Value == "" {
+				break
+			}
+
+			args, err := splitCommand(val.Value)
+			if err != nil {
+				return fmt.Errorf("line %d: %s", val.Line, err)
+			}
+			s.Args = args
+		case yaml.SequenceNode:
+			if err := val.Decode(&s.Args); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("line %d: %s takes a value or a list", val.Line, key.Value)
+		}
+	}
+
+	if s.Action == "" {
+		return fmt.Errorf("line %d: step has no action", node.Line)
+	}
+
+	return nil
+}
+
+// nodeSelector selects nodes of a testbed, either as a range or as a yaml
+// list of ranges, e.g. "[0-3]", "2" or [0, 2-4]. It selects every node
+// when empty or set to all.
+type nodeSelector string
+
+func (ns *nodeSelector) UnmarshalYAML(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		*ns = nodeSelector(node.Value)
+	case yaml.SequenceNode:
+		var parts []string
+		if err := node.Decode(&parts); err != nil {
+			return err
+		}
+		*ns = nodeSelector("[" + strings.Join(parts, ",") + "]")
+	default:
+		return fmt.Errorf("line %d: nodes must be a range or a list", node.Line)
+	}
+
+	return nil
+}
+
+func (ns nodeSelector) resolve(total int) ([]int, error) {
+	nodeRange := string(ns)
+	if nodeRange == "" || nodeRange == "all" {
+		nodeRange = fmt.Sprintf("[0-%d]", total-1)
+	}
+
+	list, err := parseRange(nodeRange)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse node range %s", nodeRange)
+	}
+
+	if err := validRange(list, total); err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+func readScenario(file string) (*scenario, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var sc scenario
+	if err := yaml.Unmarshal(data, &sc); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+
+	return &sc, nil
+}
+
+// scenarioRecord is the report of a step
+type scenarioRecord struct {
+	Step       string         `json:"step"`
+	Name       string         `json:"name"`
+	Action     string         `json:"action"`
+	Line       int            `json:"line"`
+	Status     string         `json:"status"`
+	Error      *ErrorRecord   `json:"error"`
+	DurationMs float64        `json:"duration_ms"`
+	Results    []resultRecord `json:"results,omitempty"`
+}
+
+func writeScenarioReport(file string, records []scenarioRecord) error {
+	fi, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+
+	defer fi.Close()
+
+	enc := json.NewEncoder(fi)
+	enc.SetIndent("", "  ")
+	return enc.Encode(records)
+}
+
+// scenarioRunner runs the steps of a scenario against a testbed
+type scenarioRunner struct {
+	c      *cli.Context
+	ctx    context.Context
+	dir    string
+	vars   map[string]string
+	w      io.Writer
+	format string
+	quiet  bool
+
+	records []scenarioRecord
+	// failed counts the failed assertions
+	failed int
+}
+
+// runSteps runs steps in order, their ids are prefixed with prefix
+func (r *scenarioRunner) runSteps(prefix string, steps []*scenarioStep) error {
+	for i, step := range steps {
+		id := fmt.Sprintf("%s%d", prefix, i+1)
+
+		if step.Action == "loop" {
+			if err := r.loop(id, step); err != nil {
+				return err
+			}
+			continue
+		}
+
+		start := time.Now()
+		results, err := r.runStep(step)
+		if err == nil {
+			err = checkFailures(results, 0)
+		}
+
+		rec := scenarioRecord{
+			Step:       id,
+			Name:       step.Name,
+			Action:     step.Action,
+			Line:       step.Line,
+			Status:     "ok",
+			Error:      NewErrorRecord(err),
+			DurationMs: durationMs(time.Since(start)),
+		}
+
+		for _, rs := range results {
+			rec.Results = append(rec.Results, newResultRecord(rs))
+		}
+
+		if err != nil {
+			rec.Status = "failed"
+		}
+
+		r.record(rec)
+
+		if err != nil {
+			if step.Action != "assert" {
+				return fmt.Errorf("step %s (line %d) failed", id, step.Line)
+			}
+
+			r.failed++
+		}
+
+		if r.ctx.Err() != nil {
+			return context.Cause(r.ctx)
+		}
+	}
+
+	return nil
+}
+
+func (r *scenarioRunner) record(rec scenarioRecord) {
+	r.records = append(r.records, rec)
+
+	switch r.format {
+	case formatNDJSON:
+		json.NewEncoder(r.w).Encode(rec)
+	case formatText:
+		if r.quiet && rec.Error == nil {
+			return
+		}
+
+		desc := rec.Action
+		if rec.Name != "" {
+			desc = fmt.Sprintf("%s (%s)", rec.Action, rec.Name)
+		}
+
+		dur := time.Duration(rec.DurationMs * float64(time.Millisecond)).Round(time.Millisecond)
+		fmt.Fprintf(r.w, "step %s %s: %s %s\n", rec.Step, desc, rec.Status, dur)
+
+		if rec.Error != nil {
+			for _, line := range strings.Split(rec.Error.Message, "\n") {
+				fmt.Fprintf(r.w, "  %s\n", line)
+			}
+		}
+	}
+}
+
+func (r *scenarioRunner) loop(id string, step *scenarioStep) error {
+	if len(step.Args) != 1 {
+		return fmt.Errorf("line %d: loop takes a count", step.Line)
+	}
+
+	count, err := strconv.Atoi(step.Args[0])
+	if err != nil {
+		return fmt.Errorf("line %d: loop takes a count: %s", step.Line, err)
+	}
+
+	// The iteration of an outer loop, or a var named i, is restored once the
+	// loop ends
+	outer, ok := r.vars["i"]
+	defer func() {
+		if ok {
+			r.vars["i"] = outer
+		} else {
+			delete(r.vars, "i")
+		}
+	}()
+
+	for i := 0; i < count; i++ {
+		r.vars["i"] = strconv.Itoa(i)
+		if err := r.runSteps(fmt.Sprintf("%s.%d.", id, i+1), step.Steps); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// runStep runs a step, returning the result of every node it acted on
+func (r *scenarioRunner) runStep(step *scenarioStep) ([]Result, error) {
+	switch step.Action {
+	case "create":
+		return nil, r.create(step)
+	case "init":
+		return r.mapStep(step, func(ctx context.Context, n int, node testbedi.Core) (testbedi.Output, error) {
+			return node.Init(ctx, step.Args...)
+		})
+	case "start":
+		ready := newReadiness(readyInterval, readyTimeout)
+		results, err := r.mapStep(step, func(ctx context.Context, n int, node testbedi.Core) (testbedi.Output, error) {
+			return ready.start(ctx, n, node, step.Ready, step.Args)
+		})
+		if err != nil {
+			return results, err
+		}
+
+		ready.record(results)
+		return results, r.enforcePartitions(results)
+	case "kill":
+		return r.mapStep(step, func(ctx context.Context, n int, node testbedi.Core) (testbedi.Output, error) {
+			return nil, node.Stop(ctx)
+		})
+	case "restart":
+		ready := newReadiness(readyInterval, readyTimeout)
+		results, err := r.mapStep(step, func(ctx context.Context, n int, node testbedi.Core) (testbedi.Output, error) {
+			if err := node.Stop(ctx); err != nil {
+				return nil, err
+			}
+
+			return ready.start(ctx, n, node, step.Ready, step.Args)
+		})
+		if err != nil {
+			return results, err
+		}
+
+		ready.record(results)
+		return results, r.enforcePartitions(results)
+	case "connect":
+		return r.connect(step)
+	case "run":
+		return r.run(step)
+	case "wait":
+		return r.wait(step)
+	case "assert":
+		return r.assert(step)
+	case "collect":
+		return r.collect(step)
+	case "sleep":
+		return nil, r.sleep(step)
+	}
+
+	return nil, fmt.Errorf("line %d: unknown action %s", step.Line, step.Action)
+}
+
+func (r *scenarioRunner) testbed() testbed.BasicTestbed {
+	// A new testbed is built for every step, as steps may change its nodes
+	return testbed.NewTestbed(r.dir)
+}
+
+// mapStep runs fn on every node selected by the step
+func (r *scenarioRunner) mapStep(step *scenarioStep, fn outputFunc) ([]Result, error) {
+	tb := r.testbed()
+
+	nodes, err := tb.Nodes()
+	if err != nil {
+		return nil, err
+	}
+
+	list, err := step.Nodes.resolve(len(nodes))
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %s", step.Line, err)
+	}
+
+	nw, err := netns.Load(tb.Dir())
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := newMapper(r.c)
+	if err != nil {
+		return nil, err
+	}
+
+	if step.Timeout != "" && step.Action != "wait" {
+		m.timeout, err = ParseTimeout(step.Timeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return m.mapWithOutput(list, nodes, inNetns(nw, fn))
+}
+
+// runCmd returns a function running the command of the step on a node
+func (r *scenarioRunner) runCmd(step *scenarioStep) (outputFunc, error) {
+	if len(step.Args) == 0 {
+		return nil, fmt.Errorf("line %d: %s takes a command", step.Line, step.Action)
+	}
+
+	templates, err := newNodeTemplates(r.testbed())
+	if err != nil {
+		return nil, err
+	}
+
+	templates.vars = r.vars
+
+	return func(ctx context.Context, n int, node testbedi.Core) (testbedi.Output, error) {
+		args, err := templates.expandAll(n, step.Args)
+		if err != nil {
+			return nil, err
+		}
+
+		return node.RunCmd(ctx, nil, args...)
+	}, nil
+}
+
+func (r *scenarioRunner) create(step *scenarioStep) error {
+	if len(step.Args) != 1 {
+		return fmt.Errorf("line %d: create takes a count", step.Line)
+	}
+
+	count, err := strconv.Atoi(step.Args[0])
+	if err != nil {
+		return fmt.Errorf("line %d: create takes a count: %s", step.Line, err)
+	}
+
+	if step.Type == "" {
+		return fmt.Errorf("line %d: create requires a type", step.Line)
+	}
+
+	if err := testbed.AlreadyInitCheck(r.dir, step.Force); err != nil {
+		return err
+	}
+
+	specs, err := testbed.BuildSpecs(r.dir, count, step.Type, step.Attrs)
+	if err != nil {
+		return err
+	}
+
+	return testbed.WriteNodeSpecs(r.dir, specs)
+}
+
+func (r *scenarioRunner) enforcePartitions(results []Result) error {
+	tb := r.testbed()
+
+	nodes, err := tb.Nodes()
+	if err != nil {
+		return err
+	}
+
+	return enforcePartitions(r.ctx, tb, nodes, succeeded(results))
+}
+
+func (r *scenarioRunner) connect(step *scenarioStep) ([]Result, error) {
+	tb := r.testbed()
+
+	nodes, err := tb.Nodes()
+	if err != nil {
+		return nil, err
+	}
+
+	list, err := step.Nodes.resolve(len(nodes))
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %s", step.Line, err)
+	}
+
+	edges := bipartite(list, list)
+	if len(step.Args) != 0 {
+		seed := time.Now().UnixNano()
+		if step.Seed != nil {
+			seed = *step.Seed
+		}
+
+		edges, err = buildTopology(step.Args[0], list, rand.New(rand.NewSource(seed)))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", step.Line, err)
+		}
+	}
+
+	timeout := 30 * time.Second
+	if step.Timeout != "" {
+		timeout, err = ParseTimeout(step.Timeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	m, err := newMapper(r.c)
+	if err != nil {
+		return nil, err
+	}
+
+	m.timeout = timeout
+	connected, err := connectNodes(m, tb, edges, connectOptions{
+		Backoff: time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var results []Result
+	for _, res := range connected {
+		results = append(results, Result{
+			Node:     res.From,
+			Error:    res.Error,
+			Duration: res.Latency,
+		})
+	}
+
+	return results, recordTopology(tb, connectedEdges(connected), true)
+}
+
+func (r *scenarioRunner) run(step *scenarioStep) ([]Result, error) {
+	fn, err := r.runCmd(step)
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := r.mapStep(step, fn)
+	if err != nil || step.Capture == "" {
+		return results, err
+	}
+
+	// The output is read once, so it is kept for the report as well
+	first := true
+	for i, rs := range results {
+		if rs.Output == nil {
+			continue
+		}
+
+		stdout, _ := io.ReadAll(rs.Output.Stdout())
+		stderr, _ := io.ReadAll(rs.Output.Stderr())
+		results[i].Output = &capturedOutput{Output: rs.Output, stdout: stdout, stderr: stderr}
+
+		value := strings.TrimSpace(string(stdout))
+		r.vars[fmt.Sprintf("%s.%d", step.Capture, rs.Node)] = value
+		if first {
+			r.vars[step.Capture] = value
+			first = false
+		}
+	}
+
+	return results, nil
+}
+
+// expectation returns what the output of the command of a step must look like
+func (r *scenarioRunner) expectation(step *scenarioStep) (*expectation, error) {
+	e := &expectation{Exit: step.Exit}
+	if e.Exit == nil {
+		e.Exit = new(int)
+	}
+
+	if step.Stdout != "" {
+		re, err := compileOutputRegexp(step.Stdout)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", step.Line, err)
+		}
+
+		e.Stdout = re
+	}
+
+	return e, nil
+}
+
+func (r *scenarioRunner) assert(step *scenarioStep) ([]Result, error) {
+	fn, err := r.runCmd(step)
+	if err != nil {
+		return nil, err
+	}
+
+	expect, err := r.expectation(step)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.mapStep(step, func(ctx context.Context, n int, node testbedi.Core) (testbedi.Output, error) {
+		out, err := fn(ctx, n, node)
+		if err != nil {
+			return out, err
+		}
+
+		return expect.check(out)
+	})
+}
+
+func (r *scenarioRunner) wait(step *scenarioStep) ([]Result, error) {
+	fn, err := r.runCmd(step)
+	if err != nil {
+		return nil, err
+	}
+
+	expect, err := r.expectation(step)
+	if err != nil {
+		return nil, err
+	}
+
+	interval, err := ParseTimeout(step.Interval)
+	if err != nil {
+		return nil, err
+	}
+
+	if interval == 0 {
+		interval = 500 * time.Millisecond
+	}
+
+	timeout, err := ParseTimeout(step.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if timeout == 0 {
+		timeout = time.Minute
+	}
+
+	return r.mapStep(step, func(ctx context.Context, n int, node testbedi.Core) (testbedi.Output, error) {
+		// The wait of every node is bounded, under the context of the node
+		// which --fail-fast cancels
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		out, _, err := poll(ctx, interval, func(ctx context.Context) (testbedi.Output, error) {
+			out, err := fn(ctx, n, node)
+			if err != nil {
+				return out, err
+			}
+
+			return expect.check(out)
+		})
+
+		return out, err
+	})
+}
+
+func (r *scenarioRunner) collect(step *scenarioStep) ([]Result, error) {
+	out := step.Out
+	if out == "" {
+		out = "collected"
+	}
+
+	if err := os.MkdirAll(out, 0755); err != nil {
+		return nil, err
+	}
+
+	fn := func(ctx context.Context, n int, node testbedi.Core) (testbedi.Output, error) {
+		metricNode, ok := node.(testbedi.Metric)
+		if !ok {
+			return nil, fmt.Errorf("node does not implement metrics")
+		}
+
+		stdout, err := metricNode.StdoutReader()
+		if err != nil {
+			return nil, err
+		}
+
+		stderr, err := metricNode.StderrReader()
+		if err != nil {
+			stdout.Close()
+			return nil, err
+		}
+
+		return NewOutput(stdout, stderr), nil
+	}
+
+	if len(step.Args) != 0 {
+		var err error
+		fn, err = r.runCmd(step)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return r.mapStep(step, func(ctx context.Context, n int, node testbedi.Core) (testbedi.Output, error) {
+		o, err := fn(ctx, n, node)
+		if err != nil || o == nil {
+			return o, err
+		}
+
+		if err := writeCollected(filepath.Join(out, fmt.Sprintf("%d.stdout", n)), o.Stdout()); err != nil {
+			return o, err
+		}
+
+		if err := writeCollected(filepath.Join(out, fmt.Sprintf("%d.stderr", n)), o.Stderr()); err != nil {
+			return o, err
+		}
+
+		return o, nil
+	})
+}
+
+func writeCollected(file string, r io.ReadCloser) error {
+	if r == nil {
+		return nil
+	}
+
+	defer r.Close()
+
+	fi, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+
+	defer fi.Close()
+
+	_, err = io.Copy(fi, r)
+	return err
+}
+
+func (r *scenarioRunner) sleep(step *scenarioStep) error {
+	if len(step.Args) != 1 {
+		return fmt.Errorf("line %d: sleep takes a duration", step.Line)
+	}
+
+	d, err := time.ParseDuration(step.Args[0])
+	if err != nil {
+		return fmt.Errorf("line %d: %s", step.Line, err)
+	}
+
+	select {
+	case <-time.After(d):
+		return nil
+	case <-r.ctx.Done():
+		return context.Cause(r.ctx)
+	}
+}
+
+// templateAction matches the actions of a template, which may hold spaces and
+// quotes of their own
+var templateAction = regexp.MustCompile(`{{.*?}}`)
+
+// splitCommand splits a command into words like a shell, keeping the actions
+// of templates whole, e.g. echo {{var "a b"}} is split into two words. Shell
+// operators such as ; | and & are rejected, as they are in run scripts.
+func splitCommand(s string) ([]string, error) {
+	actions := templateAction.FindAllString(s, -1)
+
+	i := 0
+	s = templateAction.ReplaceAllStringFunc(s, func(string) string {
+		i++
+		return fmt.Sprintf("\x00%d\x00", i-1)
+	})
+
+	placeholder := regexp.MustCompile("\x00([0-9]+)\x00")
+	restore := func(arg string) string {
+		return placeholder.ReplaceAllStringFunc(arg, func(m string) string {
+			n, _ := strconv.Atoi(m[1 : len(m)-1])
+			return actions[n]
+		})
+	}
+
+	parser := shellwords.NewParser()
+	args, err := parser.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+
+	// The parser stops at the first operator, which would drop the rest
+	if parser.Position >= 0 {
+		return nil, fmt.Errorf("unsupported operator %s", restore(strings.TrimSpace(s[parser.Position:])))
+	}
+
+	for j, arg := range args {
+		args[j] = restore(arg)
+	}
+
+	return args, nil
+}
@@ -0,0 +1,191 @@
+package commands
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	cli "github.com/urfave/cli"
+	"gopkg.in/yaml.v3"
+
+	testbedi "github.com/ipfs/iptb/testbed/interfaces"
+)
+
+func TestScenarioStep(t *testing.T) {
+	data := `
+steps:
+  - start:
+    ready: yes
+  - wait: [ipfs, id]
+    nodes: [0, 2-3]
+  - run: echo {{var "a b"}} 'c d'
+    capture: out
+`
+
+	var sc scenario
+	err := yaml.Unmarshal([]byte(data), &sc)
+
+	expect(t, err, nil)
+	expect(t, len(sc.Steps), 3)
+
+	expect(t, sc.Steps[0].Action, "start")
+	expect(t, sc.Steps[0].Ready, true)
+	expect(t, sc.Steps[0].Line, 3)
+
+	expect(t, sc.Steps[1].Action, "wait")
+	expect(t, sc.Steps[1].Args, []string{"ipfs", "id"})
+	expect(t, sc.Steps[1].Nodes, nodeSelector("[0,2-3]"))
+
+	expect(t, sc.Steps[2].Args, []string{"echo", `{{var "a b"}}`, "c d"})
+	expect(t, sc.Steps[2].Capture, "out")
+
+	for _, bad := range []string{
+		"steps:\n  - name: a\n",
+		"steps:\n  - run: a\n    sleep: 1s\n",
+		"steps:\n  - run: a\n    other: 1\n",
+		"steps:\n  - start:\n    wait: true\n",
+		"steps:\n  - run: echo a; echo b\n",
+	} {
+		if err := yaml.Unmarshal([]byte(bad), &sc); err == nil {
+			t.Fatalf("expected an error for %q", bad)
+		}
+	}
+}
+
+func TestSplitCommand(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected []string
+		err      string
+	}{
+		{`echo a "b c"`, []string{"echo", "a", "b c"}, ""},
+		{`echo {{var "a b"}} 'c d'`, []string{"echo", `{{var "a b"}}`, "c d"}, ""},
+		{`echo {{.PeerID | printf "%s"}}`, []string{"echo", `{{.PeerID | printf "%s"}}`}, ""},
+		{"echo a; echo b", nil, "unsupported operator ; echo b"},
+		{"ipfs id | jq .ID", nil, "unsupported operator | jq .ID"},
+		{"ipfs daemon &", nil, "unsupported operator &"},
+		{`true && echo {{var "a"}}`, nil, `unsupported operator && echo {{var "a"}}`},
+	}
+
+	for _, c := range cases {
+		args, err := splitCommand(c.input)
+		if c.err != "" {
+			if err == nil {
+				t.Fatalf("expected an error splitting %q", c.input)
+			}
+
+			expect(t, err.Error(), c.err)
+			continue
+		}
+
+		expect(t, err, nil)
+		expect(t, args, c.expected)
+	}
+}
+
+// newTestRunner returns a runner over a testbed of count nodes, which run
+// commands with run
+func newTestRunner(t *testing.T, count int, run func(ctx context.Context, stdin io.Reader, args []string) (testbedi.Output, error)) *scenarioRunner {
+	tb := newTestTestbed(t, count, func(index int) testbedi.Core {
+		return &testNode{index: index, run: run}
+	})
+
+	app := cli.NewApp()
+	app.Writer = io.Discard
+	app.ErrWriter = io.Discard
+
+	return &scenarioRunner{
+		c:      cli.NewContext(app, flag.NewFlagSet("scenario", flag.ContinueOnError), nil),
+		ctx:    context.Background(),
+		dir:    tb.Dir(),
+		vars:   make(map[string]string),
+		w:      io.Discard,
+		format: formatText,
+		quiet:  true,
+	}
+}
+
+func readTestSteps(t *testing.T, data string) []*scenarioStep {
+	var sc scenario
+	expect(t, yaml.Unmarshal([]byte(data), &sc), nil)
+
+	return sc.Steps
+}
+
+func TestScenarioCapture(t *testing.T) {
+	r := newTestRunner(t, 3, func(ctx context.Context, stdin io.Reader, args []string) (testbedi.Output, error) {
+		if args[1] == "0" {
+			return nil, fmt.Errorf("node is down")
+		}
+
+		return testOutput(args, "out"+args[1]+"\n", 0), nil
+	})
+
+	steps := readTestSteps(t, `
+steps:
+  - run: echo {{.Index}}
+    capture: out
+`)
+
+	_, err := r.run(steps[0])
+	expect(t, err, nil)
+
+	expect(t, r.vars["out"], "out1")
+	expect(t, r.vars["out.2"], "out2")
+
+	_, ok := r.vars["out.0"]
+	expect(t, ok, false)
+}
+
+func TestScenarioLoop(t *testing.T) {
+	var lk sync.Mutex
+	var ran []string
+	r := newTestRunner(t, 1, func(ctx context.Context, stdin io.Reader, args []string) (testbedi.Output, error) {
+		lk.Lock()
+		ran = append(ran, strings.Join(args[1:], " "))
+		lk.Unlock()
+
+		return testOutput(args, "", 0), nil
+	})
+
+	steps := readTestSteps(t, `
+steps:
+  - loop: 2
+    steps:
+      - loop: 2
+        steps:
+          - run: echo inner {{var "i"}}
+      - run: echo outer {{var "i"}}
+`)
+
+	expect(t, r.runSteps("", steps), nil)
+	expect(t, ran, []string{"inner 0", "inner 1", "outer 0", "inner 0", "inner 1", "outer 1"})
+
+	_, ok := r.vars["i"]
+	expect(t, ok, false)
+}
+
+func TestScenarioAssertCount(t *testing.T) {
+	r := newTestRunner(t, 2, func(ctx context.Context, stdin io.Reader, args []string) (testbedi.Output, error) {
+		return testOutput(args, "", 0), nil
+	})
+
+	steps := readTestSteps(t, `
+steps:
+  - loop: 3
+    steps:
+      - assert: "true"
+        exit: 1
+  - assert: "true"
+  - run: "true"
+`)
+
+	expect(t, r.runSteps("", steps), nil)
+	expect(t, r.failed, 3)
+	expect(t, len(r.records), 5)
+	expect(t, r.records[4].Status, "ok")
+}
@@ -0,0 +1,211 @@
+package commands
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	testbedi "github.com/ipfs/iptb/testbed/interfaces"
+	"github.com/mattn/go-shellwords"
+	cli "github.com/urfave/cli"
+)
+
+// scriptLine is a single command of a run script
+type scriptLine struct {
+	// Line is the line number of the command in the script
+	Line int
+	// Args are the node range and the command, as accepted by parseCommand
+	Args []string
+	// Background commands do not block the following ones, even when run
+	// sequentially
+	Background bool
+	// Wait lines wait for every command started before them in the stage
+	Wait bool
+}
+
+// parseScript reads the commands of a run script. Stages are separated by
+// lines holding `---`.
+func parseScript(r io.Reader) ([][]scriptLine, error) {
+	stages := [][]scriptLine{nil}
+
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		if text == "---" {
+			stages = append(stages, nil)
+			continue
+		}
+
+		cur := len(stages) - 1
+
+		if text == "wait" {
+			stages[cur] = append(stages[cur], scriptLine{Line: line, Wait: true})
+			continue
+		}
+
+		parser := shellwords.NewParser()
+		tokens, err := parser.Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("parse error on line %d: %s", line, err)
+		}
+
+		background := false
+		if parser.Position >= 0 {
+			rest := strings.TrimSpace(text[parser.Position:])
+			if rest != "&" {
+				return nil, fmt.Errorf("parse error on line %d: unsupported operator %s", line, rest)
+			}
+
+			background = true
+		}
+
+		if len(tokens) == 0 {
+			return nil, fmt.Errorf("parse error on line %d: no command", line)
+		}
+
+		stages[cur] = append(stages[cur], scriptLine{
+			Line:       line,
+			Args:       tokens,
+			Background: background,
+		})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return stages, nil
+}
+
+// scriptRunner runs the commands of a script, stage after stage
+type scriptRunner struct {
+	nodes  []testbedi.Core
+	mapper *mapper
+	// Sequential runs every command once the previous one exited, unless it
+	// is started in the background
+	Sequential bool
+	// StopOnFailure skips the remaining commands once a barrier is reached
+	// and a command failed
+	StopOnFailure bool
+
+	lk      sync.Mutex
+	wg      sync.WaitGroup
+	results [][]Result
+	errs    []error
+}
+
+// scriptCommand is a command of a script, ready to be run
+type scriptCommand struct {
+	scriptLine
+	List []int
+	Fn   outputFunc
+}
+
+// run runs every command of stages, and returns the results of every command
+// in the order of the script. skipped is the number of commands which were not
+// run, after a failure.
+func (sr *scriptRunner) run(stages [][]scriptCommand) (results [][]Result, skipped int, err error) {
+	total := 0
+	for _, stage := range stages {
+		for _, cmd := range stage {
+			if !cmd.Wait {
+				total++
+			}
+		}
+	}
+	sr.results = make([][]Result, total)
+
+	i := 0
+	stopped := false
+	for _, stage := range stages {
+		for _, cmd := range stage {
+			if stopped {
+				if !cmd.Wait {
+					skipped++
+				}
+				continue
+			}
+
+			if cmd.Wait {
+				sr.wg.Wait()
+				stopped = sr.failed()
+				continue
+			}
+
+			done := sr.start(i, cmd)
+			i++
+
+			if sr.Sequential && !cmd.Background {
+				<-done
+				stopped = sr.failed()
+			}
+		}
+
+		sr.wg.Wait()
+		if !stopped {
+			stopped = sr.failed()
+		}
+	}
+
+	if len(sr.errs) != 0 {
+		return sr.results, skipped, cli.NewMultiError(sr.errs...)
+	}
+
+	return sr.results, skipped, nil
+}
+
+func (sr *scriptRunner) start(i int, cmd scriptCommand) chan struct{} {
+	done := make(chan struct{})
+
+	sr.wg.Add(1)
+	go func() {
+		defer sr.wg.Done()
+		defer close(done)
+
+		results, err := sr.mapper.mapWithOutput(cmd.List, sr.nodes, cmd.Fn)
+
+		sr.lk.Lock()
+		defer sr.lk.Unlock()
+
+		if err != nil {
+			sr.errs = append(sr.errs, err)
+		}
+
+		sr.results[i] = results
+	}()
+
+	return done
+}
+
+// failed reports whether a command failed and the script should stop
+func (sr *scriptRunner) failed() bool {
+	if !sr.StopOnFailure {
+		return false
+	}
+
+	sr.lk.Lock()
+	defer sr.lk.Unlock()
+
+	if len(sr.errs) != 0 {
+		return true
+	}
+
+	for _, results := range sr.results {
+		for _, rs := range results {
+			if rs.Error != nil || exitFailed(rs.Output) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
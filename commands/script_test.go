@@ -0,0 +1,75 @@
+package commands
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	testbedi "github.com/ipfs/iptb/testbed/interfaces"
+)
+
+func TestParseScript(t *testing.T) {
+	script := `
+# comment
+0 -- echo a &
+wait
+---
+[1-2] -- echo "b c"
+`
+
+	stages, err := parseScript(strings.NewReader(script))
+
+	expect(t, err, nil)
+	expect(t, stages, [][]scriptLine{
+		{
+			{Line: 3, Args: []string{"0", "--", "echo", "a"}, Background: true},
+			{Line: 4, Wait: true},
+		},
+		{
+			{Line: 6, Args: []string{"[1-2]", "--", "echo", "b c"}},
+		},
+	})
+
+	_, err = parseScript(strings.NewReader("0 -- echo a | cat"))
+	if err == nil {
+		t.Fatal("expected an error for an unsupported operator")
+	}
+}
+
+func TestScriptRunnerResults(t *testing.T) {
+	e := &expectation{}
+	echo := func(stdout string) outputFunc {
+		return func(ctx context.Context, n int, node testbedi.Core) (testbedi.Output, error) {
+			return e.check(testOutput(nil, stdout, 0))
+		}
+	}
+
+	runner := &scriptRunner{
+		nodes:  newTestNodes(3, nil),
+		mapper: &mapper{ctx: context.Background()},
+	}
+
+	results, skipped, err := runner.run([][]scriptCommand{
+		{
+			{scriptLine: scriptLine{Line: 1}, List: []int{0, 1, 2}, Fn: echo("a")},
+			{scriptLine: scriptLine{Line: 2, Wait: true}},
+		},
+		{
+			{scriptLine: scriptLine{Line: 4}, List: []int{1, 2}, Fn: echo("b")},
+		},
+	})
+	expect(t, err, nil)
+	expect(t, skipped, 0)
+
+	// Results are grouped by command, whose outputs differ from each other
+	expect(t, len(results), 2)
+	expect(t, len(results[0]), 3)
+	expect(t, len(results[1]), 2)
+
+	for _, rs := range results {
+		checkSameOutput(rs)
+		for _, r := range rs {
+			expect(t, r.Error, nil)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	cli "github.com/urfave/cli"
+
+	"github.com/ipfs/iptb/testbed"
+	testbedi "github.com/ipfs/iptb/testbed/interfaces"
+)
+
+var MetricServeCmd = cli.Command{
+	Name:  "serve",
+	Usage: "expose metrics of every node to prometheus",
+	Description: `
+The serve command exposes the heartbeat and the listed metrics of every node
+of the testbed over http, in the prometheus text format:
+
+$ iptb metrics serve --listen 127.0.0.1:9100
+$ curl -s 127.0.0.1:9100/metrics | grep peers
+iptb_node_metric{testbed="default",node="0",type="localipfs",peer_id="Qm...",key="peers"} 3
+
+Every value is read when metrics are scraped, and exposed as iptb_node_metric
+with its name in the key label. Values which are not numbers are left out.
+Along with the metrics of nodes, iptb exposes:
+
+  iptb_nodes          number of nodes of the testbed
+  iptb_nodes_running  number of nodes which are up
+  iptb_node_up        1 when a node is up, 0 otherwise
+
+A node is up when its heartbeat succeeded, or for nodes without metrics when
+its process is running, or when it is ready. Nodes which can tell neither have
+no iptb_node_up, and are not counted as running.
+
+Nodes are scraped at most --concurrency at once. Reads of a node which do not
+return within --deadline are left running, and the node is reported down
+until they return, rather than read again.
+`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "listen",
+			Usage: "address to serve metrics on",
+			Value: "127.0.0.1:9100",
+		},
+		cli.StringFlag{
+			Name:  "deadline",
+			Usage: "maximum duration of the metrics of a node on every scrape",
+			Value: "5s",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		flagRoot := c.GlobalString("IPTB_ROOT")
+		flagTestbed := c.GlobalString("testbed")
+		flagQuiet := c.GlobalBool("quiet")
+		flagListen := c.String("listen")
+
+		deadline, err := time.ParseDuration(c.String("deadline"))
+		if err != nil {
+			return NewUsageError(fmt.Sprintf("invalid deadline %s: %s", c.String("deadline"), err))
+		}
+
+		ctx := rootContext(c)
+		tb := testbed.NewTestbed(path.Join(flagRoot, "testbeds", flagTestbed))
+		s := newScraper(flagTestbed, deadline, c.GlobalInt("concurrency"))
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+			// Nodes are loaded on every scrape, as the testbed may change
+			nodes, err := tb.Nodes()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			samples := s.scrape(r.Context(), nodes)
+
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			writePrometheus(w, samples)
+		})
+
+		ln, err := net.Listen("tcp", flagListen)
+		if err != nil {
+			return err
+		}
+
+		srv := &http.Server{Handler: mux}
+		go func() {
+			<-ctx.Done()
+			srv.Close()
+		}()
+
+		if !flagQuiet {
+			fmt.Fprintf(c.App.ErrWriter, "serving metrics on http://%s/metrics\n", ln.Addr())
+		}
+
+		if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+
+		return nil
+	},
+}
+
+// promSample is a sample of a prometheus gauge
+type promSample struct {
+	Name   string
+	Labels [][2]string
+	Value  float64
+}
+
+// scraper reads the metrics of nodes on every scrape. Reads can not be
+// cancelled, so a node is skipped while the reads of its last scrape are
+// pending, rather than piling them up.
+type scraper struct {
+	name     string
+	deadline time.Duration
+	// sem bounds the nodes scraped at once, across scrapes
+	sem chan struct{}
+
+	lk sync.Mutex
+	// pending holds the directories of nodes whose reads have not returned
+	pending map[string]bool
+}
+
+func newScraper(name string, deadline time.Duration, concurrency int) *scraper {
+	s := &scraper{
+		name:     name,
+		deadline: deadline,
+		pending:  make(map[string]bool),
+	}
+
+	if concurrency > 0 {
+		s.sem = make(chan struct{}, concurrency)
+	}
+
+	return s
+}
+
+// scrape reads the heartbeat and the listed metrics of every node
+func (s *scraper) scrape(ctx context.Context, nodes []testbedi.Core) []promSample {
+	var wg sync.WaitGroup
+	var lk sync.Mutex
+	var samples []promSample
+	running := 0
+
+	m := &mapper{ctx: ctx, sem: s.sem}
+	for n, node := range nodes {
+		wg.Add(1)
+		go func(n int, node testbedi.Core) {
+			defer wg.Done()
+
+			peerID, _ := node.PeerID()
+			labels := [][2]string{
+				{"testbed", s.name},
+				{"node", strconv.Itoa(n)},
+				{"type", node.Type()},
+				{"peer_id", peerID},
+			}
+
+			var values map[string]float64
+			up, known := false, true
+			if m.acquire() {
+				values, up, known = s.scrapeNode(ctx, node)
+				m.release()
+			}
+
+			lk.Lock()
+			defer lk.Unlock()
+
+			if known {
+				upValue := 0.0
+				if up {
+					upValue = 1
+					running++
+				}
+
+				samples = append(samples, promSample{Name: "iptb_node_up", Labels: labels, Value: upValue})
+			}
+
+			// Keys are labels rather than names, which may collide once
+			// sanitized, or with the metrics of iptb
+			for key, value := range values {
+				keyLabels := append(labels[:len(labels):len(labels)], [2]string{"key", key})
+				samples = append(samples, promSample{Name: "iptb_node_metric", Labels: keyLabels, Value: value})
+			}
+		}(n, node)
+	}
+
+	wg.Wait()
+
+	testbedLabels := [][2]string{{"testbed", s.name}}
+	samples = append(samples,
+		promSample{Name: "iptb_nodes", Labels: testbedLabels, Value: float64(len(nodes))},
+		promSample{Name: "iptb_nodes_running", Labels: testbedLabels, Value: float64(running)},
+	)
+
+	return samples
+}
+
+// scrapeNode returns the numeric values of the heartbeat and of the listed
+// metrics of a node, and whether its heartbeat succeeded within the deadline.
+// Nodes without metrics are up when they are ready, and known is false when
+// they can not tell either.
+func (s *scraper) scrapeNode(ctx context.Context, node testbedi.Core) (values map[string]float64, up bool, known bool) {
+	ctx, cancel := context.WithTimeout(ctx, s.deadline)
+	defer cancel()
+
+	metricNode, ok := metricsOf(node)
+	if !ok {
+		rn, ok := node.(testbedi.Readiness)
+		if !ok {
+			return nil, false, false
+		}
+
+		ready, err := rn.Ready(ctx)
+		return nil, err == nil && ready, true
+	}
+
+	s.lk.Lock()
+	if s.pending[node.Dir()] {
+		s.lk.Unlock()
+		return nil, false, true
+	}
+	s.pending[node.Dir()] = true
+	s.lk.Unlock()
+
+	beat := make(chan map[string]string, 1)
+	done := make(chan map[string]float64, 1)
+	go func() {
+		defer func() {
+			s.lk.Lock()
+			delete(s.pending, node.Dir())
+			s.lk.Unlock()
+		}()
+
+		hb, err := metricNode.Heartbeat()
+		if err != nil {
+			close(beat)
+		} else {
+			beat <- hb
+		}
+
+		metrics := make(map[string]float64)
+		for _, key := range metricNode.GetMetricList() {
+			value, err := metricNode.Metric(key)
+			if err != nil {
+				continue
+			}
+
+			if f, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				metrics[key] = f
+			}
+		}
+
+		done <- metrics
+	}()
+
+	values = make(map[string]float64)
+
+	// Values still pending past the deadline are left out
+	select {
+	case hb, ok := <-beat:
+		up = ok
+		for key, value := range hb {
+			if f, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				values[key] = f
+			}
+		}
+	case <-ctx.Done():
+		return values, false, true
+	}
+
+	select {
+	case metrics := <-done:
+		for key, value := range metrics {
+			values[key] = value
+		}
+	case <-ctx.Done():
+	}
+
+	return values, up, true
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writePrometheus writes samples in the prometheus text format, grouped and
+// sorted by name
+func writePrometheus(w io.Writer, samples []promSample) {
+	sort.SliceStable(samples, func(i, j int) bool {
+		if samples[i].Name != samples[j].Name {
+			return samples[i].Name < samples[j].Name
+		}
+
+		return promLabels(samples[i].Labels) < promLabels(samples[j].Labels)
+	})
+
+	for i, s := range samples {
+		if i == 0 || samples[i-1].Name != s.Name {
+			fmt.Fprintf(w, "# TYPE %s gauge\n", s.Name)
+		}
+
+		fmt.Fprintf(w, "%s%s %s\n", s.Name, promLabels(s.Labels), strconv.FormatFloat(s.Value, 'g', -1, 64))
+	}
+}
+
+func promLabels(labels [][2]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	parts := make([]string, len(labels))
+	for i, l := range labels {
+		parts[i] = fmt.Sprintf(`%s="%s"`, l[0], promEscaper.Replace(l[1]))
+	}
+
+	return "{" + strings.Join(parts, ",") + "}"
+}
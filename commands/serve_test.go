@@ -0,0 +1,230 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	testbedi "github.com/ipfs/iptb/testbed/interfaces"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	var buf bytes.Buffer
+	writePrometheus(&buf, []promSample{
+		{Name: "iptb_node_up", Labels: [][2]string{{"node", "1"}}, Value: 0},
+		{Name: "iptb_nodes", Labels: [][2]string{{"testbed", `a"b`}}, Value: 2},
+		{Name: "iptb_node_up", Labels: [][2]string{{"node", "0"}}, Value: 1},
+	})
+
+	expect(t, buf.String(), ""+
+		"# TYPE iptb_node_up gauge\n"+
+		"iptb_node_up{node=\"0\"} 1\n"+
+		"iptb_node_up{node=\"1\"} 0\n"+
+		"# TYPE iptb_nodes gauge\n"+
+		"iptb_nodes{testbed=\"a\\\"b\"} 2\n")
+}
+
+// slowHeartbeats blocks the heartbeats of nodes until release is closed, and
+// counts them
+type slowHeartbeats struct {
+	release chan struct{}
+	calls   int32
+	active  int32
+	max     int32
+}
+
+// slowNode is a node whose heartbeat blocks on hb
+type slowNode struct {
+	*testNode
+	hb *slowHeartbeats
+}
+
+func (n *slowNode) Heartbeat() (map[string]string, error) {
+	atomic.AddInt32(&n.hb.calls, 1)
+
+	active := atomic.AddInt32(&n.hb.active, 1)
+	defer atomic.AddInt32(&n.hb.active, -1)
+	for {
+		max := atomic.LoadInt32(&n.hb.max)
+		if active <= max || atomic.CompareAndSwapInt32(&n.hb.max, max, active) {
+			break
+		}
+	}
+
+	<-n.hb.release
+	return map[string]string{"peers": "3"}, nil
+}
+
+func newSlowNodes(count int) ([]testbedi.Core, *slowHeartbeats) {
+	hb := &slowHeartbeats{release: make(chan struct{})}
+
+	var nodes []testbedi.Core
+	for i := 0; i < count; i++ {
+		nodes = append(nodes, &slowNode{testNode: &testNode{index: i}, hb: hb})
+	}
+
+	return nodes, hb
+}
+
+func sampleValue(samples []promSample, name string) float64 {
+	for _, s := range samples {
+		if s.Name == name {
+			return s.Value
+		}
+	}
+
+	return -1
+}
+
+func TestScrapeSkipsPendingNodes(t *testing.T) {
+	nodes, hb := newSlowNodes(1)
+	s := newScraper("test", 10*time.Millisecond, 0)
+
+	for i := 0; i < 3; i++ {
+		expect(t, sampleValue(s.scrape(context.Background(), nodes), "iptb_node_up"), 0.0)
+	}
+
+	expect(t, atomic.LoadInt32(&hb.calls), int32(1))
+
+	close(hb.release)
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		s.lk.Lock()
+		pending := len(s.pending)
+		s.lk.Unlock()
+
+		if pending == 0 {
+			break
+		}
+	}
+
+	s.deadline = 5 * time.Second
+	samples := s.scrape(context.Background(), nodes)
+
+	expect(t, sampleValue(samples, "iptb_node_up"), 1.0)
+	expect(t, metricValue(samples, "0", "peers"), 3.0)
+	expect(t, atomic.LoadInt32(&hb.calls), int32(2))
+}
+
+func TestScrapeConcurrency(t *testing.T) {
+	nodes, hb := newSlowNodes(4)
+	s := newScraper("test", 5*time.Second, 2)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(hb.release)
+	}()
+
+	samples := s.scrape(context.Background(), nodes)
+
+	expect(t, sampleValue(samples, "iptb_nodes_running"), 4.0)
+	expect(t, atomic.LoadInt32(&hb.max), int32(2))
+}
+
+// metricValue returns the value of metric key of a node, or -1
+func metricValue(samples []promSample, node, key string) float64 {
+	for _, s := range samples {
+		if s.Name != "iptb_node_metric" {
+			continue
+		}
+
+		labels := make(map[string]string)
+		for _, l := range s.Labels {
+			labels[l[0]] = l[1]
+		}
+
+		if labels["node"] == node && labels["key"] == key {
+			return s.Value
+		}
+	}
+
+	return -1
+}
+
+// upValues returns iptb_node_up of every node which reported it
+func upValues(samples []promSample) map[string]float64 {
+	up := make(map[string]float64)
+	for _, s := range samples {
+		if s.Name != "iptb_node_up" {
+			continue
+		}
+
+		for _, l := range s.Labels {
+			if l[0] == "node" {
+				up[l[1]] = s.Value
+			}
+		}
+	}
+
+	return up
+}
+
+// beatNode is a node whose heartbeat returns hb
+type beatNode struct {
+	*testNode
+	hb map[string]string
+}
+
+func (n *beatNode) Heartbeat() (map[string]string, error) { return n.hb, nil }
+
+// coreNode is a node implementing nothing but the core interface
+type coreNode struct {
+	testbedi.Core
+}
+
+// processNode is a node without metrics, running as process pid
+type processNode struct {
+	testbedi.Core
+	pid int
+}
+
+func (n *processNode) PID() (int, error) {
+	if n.pid == 0 {
+		return 0, fmt.Errorf("not running")
+	}
+
+	return n.pid, nil
+}
+
+// readyOnlyNode is a node without metrics, which tells whether it is ready
+type readyOnlyNode struct {
+	testbedi.Core
+	ready bool
+}
+
+func (n *readyOnlyNode) Ready(ctx context.Context) (bool, error) { return n.ready, nil }
+
+func TestScrapeMetricKeys(t *testing.T) {
+	nodes := []testbedi.Core{&beatNode{testNode: &testNode{}, hb: map[string]string{
+		"up":      "2",
+		"cpu.pct": "3",
+		"cpu_pct": "4",
+	}}}
+
+	samples := newScraper("test", 5*time.Second, 0).scrape(context.Background(), nodes)
+
+	// Keys which would collide as metric names are kept apart as labels
+	expect(t, upValues(samples), map[string]float64{"0": 1})
+	expect(t, metricValue(samples, "0", "up"), 2.0)
+	expect(t, metricValue(samples, "0", "cpu.pct"), 3.0)
+	expect(t, metricValue(samples, "0", "cpu_pct"), 4.0)
+}
+
+func TestScrapeUpWithoutMetrics(t *testing.T) {
+	nodes := []testbedi.Core{
+		&processNode{Core: &testNode{index: 0}, pid: os.Getpid()},
+		&processNode{Core: &testNode{index: 1}},
+		&readyOnlyNode{Core: &testNode{index: 2}, ready: true},
+		&readyOnlyNode{Core: &testNode{index: 3}},
+		&coreNode{Core: &testNode{index: 4}},
+	}
+
+	samples := newScraper("test", 5*time.Second, 0).scrape(context.Background(), nodes)
+
+	expect(t, upValues(samples), map[string]float64{"0": 1, "1": 0, "2": 1, "3": 0})
+	expect(t, sampleValue(samples, "iptb_nodes"), 5.0)
+	expect(t, sampleValue(samples, "iptb_nodes_running"), 2.0)
+}
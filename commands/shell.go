@@ -9,6 +9,7 @@ import (
 	cli "github.com/urfave/cli"
 
 	"github.com/ipfs/iptb/testbed"
+	"github.com/ipfs/iptb/testbed/netns"
 )
 
 var ShellCmd = cli.Command{
@@ -36,6 +37,19 @@ var ShellCmd = cli.Command{
 			return err
 		}
 
-		return nodes[i].Shell(context.Background(), nodes)
+		if err := validRange([]int{i}, len(nodes)); err != nil {
+			return err
+		}
+
+		nw, err := netns.Load(tb.Dir())
+		if err != nil {
+			return err
+		}
+
+		// The shell is interactive, interrupts are meant for it rather than
+		// for iptb, so it does not run under the root context
+		return execNetns(nw, nodes[i].Dir(), func() error {
+			return nodes[i].Shell(context.Background(), nodes)
+		})
 	},
 }
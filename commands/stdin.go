@@ -0,0 +1,168 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// stdinSource provides the stdin of the command run on every node
+type stdinSource struct {
+	path      string
+	templates *nodeTemplates
+	fan       *fanout
+	listed    map[int]bool
+}
+
+// newStdinFile returns a source opening the file at path for every node. The
+// path is a template, expanded for every node, so every node can read its own
+// file, e.g. inputs/{{.Index}}.dat
+func newStdinFile(path string, templates *nodeTemplates) *stdinSource {
+	return &stdinSource{path: path, templates: templates}
+}
+
+// newStdinFanout returns a source copying r to every node of list. The input
+// is spooled to a temporary file, so nodes started late, e.g. once others
+// released their slot of --concurrency, replay it from the beginning, and
+// nodes which read slowly do not hold back the others.
+func newStdinFanout(r io.Reader, list []int) (*stdinSource, error) {
+	spool, err := os.CreateTemp("", "iptb-stdin-")
+	if err != nil {
+		return nil, err
+	}
+
+	// The open file keeps the input around until it is closed
+	os.Remove(spool.Name())
+
+	f := &fanout{spool: spool}
+	f.cond = sync.NewCond(&f.lk)
+
+	src := &stdinSource{fan: f, listed: make(map[int]bool)}
+	for _, n := range list {
+		src.listed[n] = true
+	}
+
+	go func() {
+		_, err := io.Copy(f, r)
+		f.close(err)
+	}()
+
+	return src, nil
+}
+
+// open returns the stdin for node `n`, and a function to release it once the
+// command exited
+func (s *stdinSource) open(n int) (io.Reader, func(), error) {
+	switch {
+	case s == nil:
+		return nil, func() {}, nil
+	case s.path != "":
+		path, err := s.templates.expand(n, s.path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("stdin file: %s", err)
+		}
+
+		fi, err := os.Open(path)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return fi, func() { fi.Close() }, nil
+	default:
+		if !s.listed[n] {
+			return nil, func() {}, nil
+		}
+
+		fr := &fanoutReader{f: s.fan}
+		return fr, fr.Close, nil
+	}
+}
+
+// close releases the spool of a fanout, once every node is done with it
+func (s *stdinSource) close() {
+	if s != nil && s.fan != nil {
+		s.fan.spool.Close()
+	}
+}
+
+// fanout spools its input to a file, which readers read at their own pace
+type fanout struct {
+	lk    sync.Mutex
+	cond  *sync.Cond
+	spool *os.File
+	size  int64
+	done  bool
+	err   error
+}
+
+func (f *fanout) Write(p []byte) (int, error) {
+	n, err := f.spool.Write(p)
+
+	f.lk.Lock()
+	defer f.lk.Unlock()
+
+	f.size += int64(n)
+	f.cond.Broadcast()
+
+	return n, err
+}
+
+// close marks the end of the input, err being the error it ended with
+func (f *fanout) close(err error) {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+
+	f.done = true
+	f.err = err
+	f.cond.Broadcast()
+}
+
+// fanoutReader reads the input of a fanout from the beginning
+type fanoutReader struct {
+	f      *fanout
+	off    int64
+	closed bool
+}
+
+func (r *fanoutReader) Read(p []byte) (int, error) {
+	f := r.f
+
+	f.lk.Lock()
+	for r.off >= f.size && !f.done && !r.closed {
+		f.cond.Wait()
+	}
+
+	size, done, err, closed := f.size, f.done, f.err, r.closed
+	f.lk.Unlock()
+
+	switch {
+	case closed:
+		return 0, io.ErrClosedPipe
+	case r.off >= size && done && err != nil:
+		return 0, err
+	case r.off >= size && done:
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > size-r.off {
+		p = p[:size-r.off]
+	}
+
+	n, err := f.spool.ReadAt(p, r.off)
+	r.off += int64(n)
+	if err == io.EOF {
+		err = nil
+	}
+
+	return n, err
+}
+
+// Close releases the reader, unblocking a pending Read
+func (r *fanoutReader) Close() {
+	r.f.lk.Lock()
+	defer r.f.lk.Unlock()
+
+	r.closed = true
+	r.f.cond.Broadcast()
+}
@@ -0,0 +1,162 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ipfs/iptb/testbed"
+	testbedi "github.com/ipfs/iptb/testbed/interfaces"
+)
+
+// readStdin reads the stdin opened for node `n`, or returns nil when the node
+// has none
+func readStdin(t *testing.T, src *stdinSource, n int) []byte {
+	stdin, done, err := src.open(n)
+	expect(t, err, nil)
+	defer done()
+
+	if stdin == nil {
+		return nil
+	}
+
+	data, err := io.ReadAll(stdin)
+	expect(t, err, nil)
+
+	return data
+}
+
+func TestStdinNone(t *testing.T) {
+	var src *stdinSource
+
+	expect(t, readStdin(t, src, 0), []byte(nil))
+	src.close()
+}
+
+func TestStdinFile(t *testing.T) {
+	dir := t.TempDir()
+	for n, data := range []string{"zero", "one"} {
+		expect(t, os.WriteFile(filepath.Join(dir, fmt.Sprintf("%d.dat", n)), []byte(data), 0644), nil)
+	}
+
+	nt := &nodeTemplates{nodes: newTestNodes(3, nil), specs: []*testbed.NodeSpec{{}, {}, {}}}
+
+	// Every node reads its own file
+	src := newStdinFile(filepath.Join(dir, "{{.Index}}.dat"), nt)
+	expect(t, string(readStdin(t, src, 0)), "zero")
+	expect(t, string(readStdin(t, src, 1)), "one")
+
+	_, _, err := src.open(2)
+	if !os.IsNotExist(err) {
+		t.Errorf("expected a missing file for node[2], got %v", err)
+	}
+
+	// Or the same file
+	src = newStdinFile(filepath.Join(dir, "1.dat"), nt)
+	expect(t, string(readStdin(t, src, 0)), "one")
+	expect(t, string(readStdin(t, src, 2)), "one")
+
+	src = newStdinFile(filepath.Join(dir, "{{.Missing}}.dat"), nt)
+	_, _, err = src.open(0)
+	if err == nil || !strings.HasPrefix(err.Error(), "stdin file: ") {
+		t.Errorf("expected an error expanding the path, got %v", err)
+	}
+}
+
+func TestStdinFanout(t *testing.T) {
+	src, err := newStdinFanout(strings.NewReader("data\n"), []int{0, 2})
+	expect(t, err, nil)
+	defer src.close()
+
+	// Nodes of the list read the whole input, whenever they start
+	expect(t, string(readStdin(t, src, 0)), "data\n")
+	expect(t, string(readStdin(t, src, 2)), "data\n")
+	expect(t, readStdin(t, src, 1), []byte(nil))
+	expect(t, string(readStdin(t, src, 0)), "data\n")
+}
+
+func TestStdinFanoutClose(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+
+	src, err := newStdinFanout(pr, []int{0})
+	expect(t, err, nil)
+	defer src.close()
+
+	stdin, done, err := src.open(0)
+	expect(t, err, nil)
+
+	// Releasing a node unblocks its pending read of an input not yet written
+	read := make(chan error)
+	go func() {
+		_, err := stdin.Read(make([]byte, 1))
+		read <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	done()
+
+	select {
+	case err := <-read:
+		expect(t, err, io.ErrClosedPipe)
+	case <-time.After(5 * time.Second):
+		t.Fatal("read not unblocked")
+	}
+}
+
+func TestStdinFanoutConcurrency(t *testing.T) {
+	pr, pw := io.Pipe()
+	go func() {
+		for i := 0; i < 3; i++ {
+			io.WriteString(pw, strings.Repeat("x", 64*1024))
+			time.Sleep(10 * time.Millisecond)
+		}
+		pw.Close()
+	}()
+
+	list := []int{0, 1, 2, 3}
+	input, err := newStdinFanout(pr, list)
+	expect(t, err, nil)
+	defer input.close()
+
+	nodes := newTestNodes(len(list), func(ctx context.Context, stdin io.Reader, args []string) (testbedi.Output, error) {
+		data, err := io.ReadAll(stdin)
+		return testOutput(args, string(data), 0), err
+	})
+
+	runCmd := func(ctx context.Context, n int, node testbedi.Core) (testbedi.Output, error) {
+		stdin, done, err := input.open(n)
+		if err != nil {
+			return nil, err
+		}
+
+		defer done()
+		return node.RunCmd(ctx, stdin)
+	}
+
+	// Fewer slots than nodes, the last nodes start once the input ended
+	m := &mapper{ctx: context.Background(), sem: make(chan struct{}, 2)}
+
+	finished := make(chan []Result)
+	go func() {
+		results, _ := m.mapWithOutput(list, nodes, runCmd)
+		finished <- results
+	}()
+
+	select {
+	case results := <-finished:
+		for _, rs := range results {
+			expect(t, rs.Error, nil)
+
+			data, _ := io.ReadAll(rs.Output.Stdout())
+			expect(t, len(data), 3*64*1024)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("fanout deadlocked")
+	}
+}
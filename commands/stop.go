@@ -9,6 +9,7 @@ import (
 
 	"github.com/ipfs/iptb/testbed"
 	testbedi "github.com/ipfs/iptb/testbed/interfaces"
+	"github.com/ipfs/iptb/testbed/netns"
 )
 
 var StopCmd = cli.Command{
@@ -16,10 +17,18 @@ var StopCmd = cli.Command{
 	Name:      "stop",
 	Usage:     "stop specified nodes (or all)",
 	ArgsUsage: "[nodes]",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "timeout",
+			Usage: "maximum duration of the command on every node, e.g. 30s",
+		},
+	},
 	Action: func(c *cli.Context) error {
 		flagRoot := c.GlobalString("IPTB_ROOT")
 		flagTestbed := c.GlobalString("testbed")
 		flagQuiet := c.GlobalBool("quiet")
+		flagFormat := c.GlobalString("format")
+		flagAllowFailures := c.GlobalInt("allow-failures")
 
 		tb := testbed.NewTestbed(path.Join(flagRoot, "testbeds", flagTestbed))
 		nodes, err := tb.Nodes()
@@ -38,15 +47,25 @@ var StopCmd = cli.Command{
 			return fmt.Errorf("could not parse node range %s", nodeRange)
 		}
 
-		runCmd := func(node testbedi.Core) (testbedi.Output, error) {
-			return nil, node.Stop(context.Background())
+		runCmd := func(ctx context.Context, n int, node testbedi.Core) (testbedi.Output, error) {
+			return nil, node.Stop(ctx)
+		}
+
+		nw, err := netns.Load(tb.Dir())
+		if err != nil {
+			return err
+		}
+
+		m, err := newMapper(c)
+		if err != nil {
+			return err
 		}
 
-		results, err := mapWithOutput(list, nodes, runCmd)
+		results, err := m.mapWithOutput(list, nodes, inNetns(nw, runCmd))
 		if err != nil {
 			return err
 		}
 
-		return buildReport(results, flagQuiet)
+		return buildReport(results, flagQuiet, flagFormat, flagAllowFailures)
 	},
 }
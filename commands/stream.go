@@ -0,0 +1,191 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	testbedi "github.com/ipfs/iptb/testbed/interfaces"
+)
+
+// nodeColors are the ANSI colors cycled through to tell nodes apart
+var nodeColors = []int{31, 32, 33, 34, 35, 36}
+
+// streamer prints the output of commands, line by line as it is produced,
+// prefixed with the node it came from
+type streamer struct {
+	lk         sync.Mutex
+	stdout     io.Writer
+	stderr     io.Writer
+	format     string
+	color      bool
+	timestamps bool
+}
+
+// streamLine is the ndjson form of a line of output
+type streamLine struct {
+	Node   int    `json:"node"`
+	Stream string `json:"stream"`
+	Time   string `json:"time"`
+	Line   string `json:"line"`
+}
+
+func (s *streamer) emit(n int, stream string, line []byte) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	now := time.Now()
+
+	w := s.stdout
+	if stream == "stderr" {
+		w = s.stderr
+	}
+
+	if s.format == formatNDJSON {
+		// Both streams are kept on stdout, so they remain a single document
+		json.NewEncoder(s.stdout).Encode(streamLine{
+			Node:   n,
+			Stream: stream,
+			Time:   now.Format(time.RFC3339Nano),
+			Line:   string(line),
+		})
+		return
+	}
+
+	var b strings.Builder
+	if s.timestamps {
+		b.WriteString(now.Format("15:04:05.000 "))
+	}
+
+	prefix := fmt.Sprintf("[node %d]", n)
+	if s.color {
+		prefix = fmt.Sprintf("\x1b[%dm%s\x1b[0m", nodeColors[n%len(nodeColors)], prefix)
+	}
+
+	b.WriteString(prefix)
+	b.WriteString(" ")
+	b.Write(line)
+	b.WriteString("\n")
+
+	io.WriteString(w, b.String())
+}
+
+// writer returns a writer which emits every complete line written to it
+func (s *streamer) writer(n int, stream string) *lineWriter {
+	return &lineWriter{
+		emit: func(line []byte) {
+			s.emit(n, stream, line)
+		},
+	}
+}
+
+// lineWriter buffers writes until a line is complete
+type lineWriter struct {
+	lk   sync.Mutex
+	buf  []byte
+	emit func([]byte)
+}
+
+func (lw *lineWriter) Write(p []byte) (int, error) {
+	lw.lk.Lock()
+	defer lw.lk.Unlock()
+
+	lw.buf = append(lw.buf, p...)
+	for {
+		i := bytes.IndexByte(lw.buf, '\n')
+		if i < 0 {
+			break
+		}
+
+		lw.emit(bytes.TrimSuffix(lw.buf[:i], []byte("\r")))
+		lw.buf = lw.buf[i+1:]
+	}
+
+	return len(p), nil
+}
+
+// Flush emits the last line, when it did not end with a newline
+func (lw *lineWriter) Flush() {
+	lw.lk.Lock()
+	defer lw.lk.Unlock()
+
+	if len(lw.buf) != 0 {
+		lw.emit(lw.buf)
+		lw.buf = nil
+	}
+}
+
+// run runs a command on node `n`, streaming its output. Nodes which can not
+// stream have their output printed once the command exits.
+func (s *streamer) run(ctx context.Context, n int, node testbedi.Core, stdin io.Reader, args []string) (testbedi.Output, error) {
+	stdout := s.writer(n, "stdout")
+	stderr := s.writer(n, "stderr")
+
+	var out testbedi.Output
+	var err error
+	if sn, ok := node.(testbedi.Streamer); ok {
+		out, err = sn.RunCmdStream(ctx, stdin, stdout, stderr, args...)
+	} else {
+		out, err = node.RunCmd(ctx, stdin, args...)
+		if out != nil {
+			io.Copy(stdout, out.Stdout())
+			io.Copy(stderr, out.Stderr())
+		}
+	}
+
+	stdout.Flush()
+	stderr.Flush()
+
+	if out == nil {
+		return nil, err
+	}
+
+	return &streamedOutput{out}, err
+}
+
+// report prints the exit code of every node once all commands exited
+func (s *streamer) report(results []Result, quiet bool, allow int) error {
+	if s.format != formatText {
+		return buildReport(results, quiet, s.format, allow)
+	}
+
+	for _, rs := range results {
+		if quiet || rs.Output == nil {
+			continue
+		}
+
+		line := fmt.Sprintf("exit %d", rs.Output.ExitCode())
+		if rs.Output.Error() != nil {
+			line = fmt.Sprintf("%s: %s", line, rs.Output.Error())
+		}
+
+		s.emit(rs.Node, "stdout", []byte(line))
+	}
+
+	if !quiet {
+		s.lk.Lock()
+		writeSummary(s.stderr, results)
+		s.lk.Unlock()
+	}
+
+	return checkFailures(results, allow)
+}
+
+// streamedOutput is the Output of a command whose stdout and stderr were
+// already printed
+type streamedOutput struct {
+	testbedi.Output
+}
+
+func (o *streamedOutput) Stdout() io.ReadCloser {
+	return io.NopCloser(strings.NewReader(""))
+}
+
+func (o *streamedOutput) Stderr() io.ReadCloser {
+	return io.NopCloser(strings.NewReader(""))
+}
@@ -0,0 +1,19 @@
+package commands
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestStreamerWriter(t *testing.T) {
+	var buf bytes.Buffer
+	s := &streamer{stdout: &buf, stderr: &buf, format: formatText}
+
+	w := s.writer(3, "stdout")
+	io.WriteString(w, "a\nb")
+	io.WriteString(w, "c\r\nd")
+	w.Flush()
+
+	expect(t, buf.String(), "[node 3] a\n[node 3] bc\n[node 3] d\n")
+}
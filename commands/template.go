@@ -0,0 +1,148 @@
+package commands
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/ipfs/iptb/testbed"
+	testbedi "github.com/ipfs/iptb/testbed/interfaces"
+)
+
+// templateNode exposes the facts of a node to templates
+type templateNode struct {
+	Index int
+
+	node testbedi.Core
+	spec *testbed.NodeSpec
+}
+
+func (t *templateNode) PeerID() (string, error) {
+	return t.node.PeerID()
+}
+
+func (t *templateNode) APIAddr() (string, error) {
+	return t.node.APIAddr()
+}
+
+func (t *templateNode) SwarmAddrs() ([]string, error) {
+	return t.node.SwarmAddrs()
+}
+
+func (t *templateNode) Dir() string {
+	return t.node.Dir()
+}
+
+func (t *templateNode) Type() string {
+	return t.node.Type()
+}
+
+func (t *templateNode) Attr(name string) (string, error) {
+	return nodeAttr(t.spec, t.node, name)
+}
+
+// nodeTemplates holds the nodes of a testbed, to expand templates against
+type nodeTemplates struct {
+	nodes []testbedi.Core
+	specs []*testbed.NodeSpec
+	// vars are the variables available through the var function
+	vars map[string]string
+}
+
+func newNodeTemplates(tb testbed.BasicTestbed) (*nodeTemplates, error) {
+	specs, err := tb.Specs()
+	if err != nil {
+		return nil, err
+	}
+
+	nodes, err := tb.Nodes()
+	if err != nil {
+		return nil, err
+	}
+
+	return &nodeTemplates{nodes: nodes, specs: specs}, nil
+}
+
+func (nt *nodeTemplates) node(n int) (*templateNode, error) {
+	if n < 0 || n >= len(nt.nodes) {
+		return nil, fmt.Errorf("node %d outside of valid range [0-%d]", n, len(nt.nodes)-1)
+	}
+
+	return &templateNode{Index: n, node: nt.nodes[n], spec: nt.specs[n]}, nil
+}
+
+// expand executes text as a template for node `n`
+func (nt *nodeTemplates) expand(n int, text string) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+
+	self, err := nt.node(n)
+	if err != nil {
+		return "", err
+	}
+
+	tmpl, err := template.New("").Option("missingkey=error").Funcs(template.FuncMap{
+		"node": nt.node,
+		"attr": self.Attr,
+		"first": func(list []string) (string, error) {
+			if len(list) == 0 {
+				return "", fmt.Errorf("first of empty list")
+			}
+
+			return list[0], nil
+		},
+		"join": func(list []string, sep string) string {
+			return strings.Join(list, sep)
+		},
+		"var": func(name string) (string, error) {
+			v, ok := nt.vars[name]
+			if !ok {
+				return "", fmt.Errorf("variable %s not set", name)
+			}
+
+			return v, nil
+		},
+	}).Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var out strings.Builder
+	if err := tmpl.Execute(&out, self); err != nil {
+		return "", err
+	}
+
+	return out.String(), nil
+}
+
+// expandAll executes every element of args as a template for node `n`
+func (nt *nodeTemplates) expandAll(n int, args []string) ([]string, error) {
+	out := make([]string, len(args))
+	for i, arg := range args {
+		var err error
+		out[i], err = nt.expand(n, arg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
+
+// nodeAttr reads an attribute of a node from its spec, falling back to the
+// node itself when it implements attributes
+func nodeAttr(spec *testbed.NodeSpec, node testbedi.Core, name string) (string, error) {
+	if spec != nil {
+		if v, err := spec.GetAttr(name); err == nil {
+			return v, nil
+		}
+	}
+
+	attrNode, ok := node.(testbedi.Attribute)
+	if !ok {
+		return "", fmt.Errorf("attribute %s not set", name)
+	}
+
+	return attrNode.Attr(name)
+}
@@ -0,0 +1,142 @@
+package commands
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	cli "github.com/urfave/cli"
+
+	"github.com/ipfs/iptb/testbed"
+	testbedi "github.com/ipfs/iptb/testbed/interfaces"
+)
+
+// addrNode is a node listening on addrs
+type addrNode struct {
+	*testNode
+	addrs []string
+}
+
+func (n *addrNode) SwarmAddrs() ([]string, error) { return n.addrs, nil }
+
+func TestNodeTemplatesExpand(t *testing.T) {
+	nt := &nodeTemplates{
+		nodes: []testbedi.Core{
+			&addrNode{testNode: &testNode{index: 0}, addrs: []string{"/ip4/127.0.0.1/tcp/4001", "/ip4/127.0.0.1/udp/4001"}},
+			&addrNode{testNode: &testNode{index: 1}},
+		},
+		specs: []*testbed.NodeSpec{
+			{Attrs: map[string]string{"role": "seed"}},
+			{},
+		},
+		vars: map[string]string{"cid": "QmFoo"},
+	}
+
+	cases := []struct {
+		node     int
+		text     string
+		expected string
+		err      string
+	}{
+		{0, "plain text", "plain text", ""},
+		{1, "{{.Index}}", "1", ""},
+		{1, "{{.PeerID}}", "Qm1", ""},
+		{1, "{{.Dir}}/{{.Type}}", "/tmp/iptb-test/1/test", ""},
+		{1, "{{(node 0).PeerID}}", "Qm0", ""},
+		{0, `{{attr "role"}}`, "seed", ""},
+		{0, `{{.Attr "role"}}`, "seed", ""},
+		{0, "{{first .SwarmAddrs}}", "/ip4/127.0.0.1/tcp/4001", ""},
+		{1, `{{join (node 0).SwarmAddrs ","}}`, "/ip4/127.0.0.1/tcp/4001,/ip4/127.0.0.1/udp/4001", ""},
+		{1, `{{var "cid"}}`, "QmFoo", ""},
+
+		{1, `{{attr "role"}}`, "", "attribute role not set"},
+		{0, "{{(node 2).PeerID}}", "", "node 2 outside of valid range [0-1]"},
+		{1, "{{first .SwarmAddrs}}", "", "first of empty list"},
+		{0, `{{var "missing"}}`, "", "variable missing not set"},
+		{0, "{{.Missing}}", "", "can't evaluate field Missing"},
+		{0, "{{(node 1).Missing}}", "", "can't evaluate field Missing"},
+		{0, "{{.Index", "", "unclosed action"},
+	}
+
+	for _, c := range cases {
+		out, err := nt.expand(c.node, c.text)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("expanding %q: expected an error containing %q, got %v", c.text, c.err, err)
+			}
+			continue
+		}
+
+		expect(t, err, nil)
+		expect(t, out, c.expected)
+	}
+}
+
+func TestNodeTemplatesExpandAll(t *testing.T) {
+	nt := &nodeTemplates{nodes: newTestNodes(2, nil), specs: []*testbed.NodeSpec{{}, {}}}
+
+	out, err := nt.expandAll(1, []string{"swarm", "connect", "{{(node 0).PeerID}}", "--arg={{.Index}}"})
+	expect(t, err, nil)
+	expect(t, out, []string{"swarm", "connect", "Qm0", "--arg=1"})
+
+	_, err = nt.expandAll(1, []string{"echo", "{{(node 5).PeerID}}"})
+	if err == nil || !strings.Contains(err.Error(), "node 5 outside of valid range [0-1]") {
+		t.Errorf("expected an error on a node out of range, got %v", err)
+	}
+}
+
+// runTemplated runs `iptb run` with args on a testbed of two nodes, and
+// returns the arguments every node was run with
+func runTemplated(t *testing.T, args ...string) [][]string {
+	var lk sync.Mutex
+	got := make([][]string, 2)
+
+	tb := newTestTestbed(t, 2, func(index int) testbedi.Core {
+		return &testNode{index: index, run: func(ctx context.Context, stdin io.Reader, args []string) (testbedi.Output, error) {
+			lk.Lock()
+			defer lk.Unlock()
+
+			got[index] = args
+			return testOutput(args, "", 0), nil
+		}}
+	})
+
+	root := t.TempDir()
+	expect(t, os.Mkdir(filepath.Join(root, "testbeds"), 0775), nil)
+	expect(t, os.Symlink(tb.Dir(), filepath.Join(root, "testbeds", "default")), nil)
+
+	app := cli.NewApp()
+	app.Writer = io.Discard
+	app.ErrWriter = io.Discard
+	app.Flags = []cli.Flag{
+		cli.StringFlag{Name: "IPTB_ROOT"},
+		cli.StringFlag{Name: "testbed", Value: "default"},
+		cli.BoolFlag{Name: "quiet"},
+		cli.StringFlag{Name: "format", Value: formatText},
+	}
+	app.Commands = []cli.Command{RunCmd}
+
+	err := app.Run(append([]string{"iptb", "--IPTB_ROOT", root, "--quiet", "run"}, args...))
+	expect(t, err, nil)
+
+	return got
+}
+
+func TestRunTemplates(t *testing.T) {
+	// Arguments are expanded by default, those without templates are kept as is
+	got := runTemplated(t, "--", "swarm", "connect", "{{(node 1).PeerID}}", "--index={{.Index}}")
+	expect(t, got, [][]string{
+		{"swarm", "connect", "Qm1", "--index=0"},
+		{"swarm", "connect", "Qm1", "--index=1"},
+	})
+
+	got = runTemplated(t, "--no-template", "--", "echo", "{{.Index}}")
+	expect(t, got, [][]string{
+		{"echo", "{{.Index}}"},
+		{"echo", "{{.Index}}"},
+	})
+}
@@ -3,11 +3,15 @@ package commands
 import (
 	"context"
 	"fmt"
+	"os"
 	"path"
 
 	cli "github.com/urfave/cli"
 
 	"github.com/ipfs/iptb/testbed"
+	testbedi "github.com/ipfs/iptb/testbed/interfaces"
+	"github.com/ipfs/iptb/testbed/netns"
+	iptbutil "github.com/ipfs/iptb/util"
 )
 
 var TestbedCmd = cli.Command{
@@ -15,6 +19,7 @@ var TestbedCmd = cli.Command{
 	Usage: "manage testbeds",
 	Subcommands: []cli.Command{
 		TestbedCreateCmd,
+		TestbedRmCmd,
 	},
 }
 
@@ -45,6 +50,15 @@ var TestbedCreateCmd = cli.Command{
 			Name:  "init",
 			Usage: "initialize after creation (like calling `init` after create)",
 		},
+		cli.BoolFlag{
+			Name:  "netns",
+			Usage: "isolate every node in its own network namespace (requires root)",
+		},
+		cli.StringFlag{
+			Name:  "subnet",
+			Usage: "subnet to allocate node addresses from when using -netns",
+			Value: "10.77.0.0/16",
+		},
 	},
 	Action: func(c *cli.Context) error {
 		flagRoot := c.GlobalString("IPTB_ROOT")
@@ -54,6 +68,8 @@ var TestbedCreateCmd = cli.Command{
 		flagCount := c.Int("count")
 		flagForce := c.Bool("force")
 		flagAttrs := c.StringSlice("attr")
+		flagNetns := c.Bool("netns")
+		flagSubnet := c.String("subnet")
 
 		attrs := parseAttrSlice(flagAttrs)
 		tb := testbed.NewTestbed(path.Join(flagRoot, "testbeds", flagTestbed))
@@ -79,14 +95,29 @@ var TestbedCreateCmd = cli.Command{
 			return err
 		}
 
+		if flagNetns {
+			if err := setupNetns(tb, flagSubnet); err != nil {
+				return err
+			}
+		}
+
 		if flagInit {
 			nodes, err := tb.Nodes()
 			if err != nil {
 				return err
 			}
 
+			nw, err := netns.Load(tb.Dir())
+			if err != nil {
+				return err
+			}
+
 			for _, n := range nodes {
-				if _, err := n.Init(context.Background()); err != nil {
+				err := execNetns(nw, n.Dir(), func() error {
+					_, err := n.Init(rootContext(c))
+					return err
+				})
+				if err != nil {
 					return err
 				}
 			}
@@ -95,3 +126,60 @@ var TestbedCreateCmd = cli.Command{
 		return nil
 	},
 }
+
+var TestbedRmCmd = cli.Command{
+	Name:  "rm",
+	Usage: "stop nodes and remove testbed",
+	Description: `
+The rm command stops every node of the testbed, removes the network namespaces
+and links created for it, and deletes the testbed directory.
+`,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "force",
+			Usage: "do not ask for confirmation",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		flagRoot := c.GlobalString("IPTB_ROOT")
+		flagTestbed := c.GlobalString("testbed")
+		flagForce := c.Bool("force")
+
+		tb := testbed.NewTestbed(path.Join(flagRoot, "testbeds", flagTestbed))
+
+		if _, err := os.Stat(tb.Dir()); os.IsNotExist(err) {
+			return fmt.Errorf("testbed %s does not exist", flagTestbed)
+		}
+
+		if !flagForce && !iptbutil.YesNoPrompt(fmt.Sprintf("remove testbed %s?", flagTestbed)) {
+			return nil
+		}
+
+		// Nodes which are not running fail to stop, which is fine as long
+		// as nothing is left behind
+		if nodes, err := tb.Nodes(); err == nil {
+			nw, err := netns.Load(tb.Dir())
+			if err != nil {
+				return err
+			}
+
+			list := make([]int, len(nodes))
+			for i := range nodes {
+				list[i] = i
+			}
+
+			stopCmd := func(ctx context.Context, n int, node testbedi.Core) (testbedi.Output, error) {
+				return nil, node.Stop(ctx)
+			}
+
+			m, err := newMapper(c)
+			if err != nil {
+				return err
+			}
+
+			m.mapWithOutput(list, nodes, inNetns(nw, stopCmd))
+		}
+
+		return testbed.RemoveTestbed(tb.Dir())
+	},
+}
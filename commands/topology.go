@@ -0,0 +1,443 @@
+package commands
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	cli "github.com/urfave/cli"
+
+	"github.com/ipfs/iptb/testbed"
+	testbedi "github.com/ipfs/iptb/testbed/interfaces"
+	"github.com/ipfs/iptb/testbed/netns"
+)
+
+var TopologyCmd = cli.Command{
+	Category:  "NETWORK",
+	Name:      "topology",
+	Usage:     "export the observed connections between nodes",
+	ArgsUsage: "[nodes]",
+	Description: `
+The topology command asks every node for the peers it is connected to, and maps
+the peer ids back to node indexes. Nodes must implement peers.
+
+The graph is exported as dot (default) or graphml, chosen with --graph-format,
+or as json with the global --format json or ndjson. Connections to peers which
+are not part of the testbed are marked as external.
+
+With --diff, the observed graph is compared against the connections requested
+through ` + "`iptb connect`" + `: requested connections which were not observed are
+marked as missing, observed connections which were never requested are marked
+as unexpected.
+
+$ iptb topology --graph-format dot | dot -Tsvg > topology.svg
+$ iptb --format json topology --diff
+`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "graph-format",
+			Usage: "graph format: dot or graphml",
+			Value: "dot",
+		},
+		cli.BoolFlag{
+			Name:  "diff",
+			Usage: "compare against the connections requested through connect",
+		},
+		cli.StringFlag{
+			Name:  "timeout",
+			Usage: "timeout on listing the peers of a node",
+			Value: "30s",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		flagRoot := c.GlobalString("IPTB_ROOT")
+		flagTestbed := c.GlobalString("testbed")
+		flagFormat := c.GlobalString("format")
+		flagGraphFormat := c.String("graph-format")
+		flagDiff := c.Bool("diff")
+		flagTimeout := c.String("timeout")
+
+		if flagGraphFormat != "dot" && flagGraphFormat != "graphml" {
+			return NewUsageError(fmt.Sprintf("unknown graph format %s, expected dot or graphml", flagGraphFormat))
+		}
+
+		if c.IsSet("graph-format") && flagFormat != formatText {
+			return NewUsageError("--graph-format can not be used with --format " + flagFormat)
+		}
+
+		timeout, err := time.ParseDuration(flagTimeout)
+		if err != nil {
+			return err
+		}
+
+		tb := testbed.NewTestbed(path.Join(flagRoot, "testbeds", flagTestbed))
+		nodes, err := tb.Nodes()
+		if err != nil {
+			return err
+		}
+
+		nodeRange := c.Args().First()
+		if nodeRange == "" {
+			nodeRange = fmt.Sprintf("[0-%d]", len(nodes)-1)
+		}
+
+		list, err := parseRange(nodeRange)
+		if err != nil {
+			return fmt.Errorf("could not parse node range %s", nodeRange)
+		}
+
+		if err := validRange(list, len(nodes)); err != nil {
+			return err
+		}
+
+		nw, err := netns.Load(tb.Dir())
+		if err != nil {
+			return err
+		}
+
+		m, err := newMapper(c)
+		if err != nil {
+			return err
+		}
+
+		topo, err := observeTopology(m, nw, nodes, list, timeout)
+		if err != nil {
+			return err
+		}
+
+		if flagDiff {
+			requested, err := testbed.ReadTopology(tb.Dir())
+			if err != nil {
+				return err
+			}
+
+			topo.diff(requested, list)
+		}
+
+		return writeFormatted(c.App.Writer, flagFormat, topo, func(w io.Writer) error {
+			if flagGraphFormat == "graphml" {
+				return topo.writeGraphML(w)
+			}
+
+			return topo.writeDot(w)
+		})
+	},
+}
+
+type topologyNode struct {
+	Index  int    `json:"index"`
+	PeerID string `json:"peer_id"`
+}
+
+type topologyEdge struct {
+	From int `json:"from"`
+	To   int `json:"to"`
+}
+
+type topologyExternal struct {
+	From int    `json:"from"`
+	Peer string `json:"peer"`
+}
+
+// observedTopology is the graph of connections reported by nodes
+type observedTopology struct {
+	Nodes      []topologyNode     `json:"nodes"`
+	Edges      []topologyEdge     `json:"edges"`
+	External   []topologyExternal `json:"external"`
+	Missing    []topologyEdge     `json:"missing,omitempty"`
+	Unexpected []topologyEdge     `json:"unexpected,omitempty"`
+	Errors     map[int]string     `json:"errors,omitempty"`
+}
+
+// peerIDFromAddr accepts either a bare peer id, or a multiaddr ending in one
+func peerIDFromAddr(s string) string {
+	for _, proto := range []string{"/p2p/", "/ipfs/"} {
+		if i := strings.LastIndex(s, proto); i != -1 {
+			return s[i+len(proto):]
+		}
+	}
+
+	return s
+}
+
+func observeTopology(m *mapper, nw *netns.Network, nodes []testbedi.Core, list []int, timeout time.Duration) (*observedTopology, error) {
+	topo := &observedTopology{
+		Errors: make(map[int]string),
+	}
+
+	// Peer ids are mapped back to every node of the testbed, not only the
+	// ones inspected, so that nodes outside of the range are not external
+	index := make(map[string]int)
+	for i, node := range nodes {
+		id, err := node.PeerID()
+		if err != nil {
+			return nil, fmt.Errorf("node[%d]: %w", i, err)
+		}
+
+		index[id] = i
+	}
+
+	peers := make([][]string, len(list))
+	errs := make([]error, len(list))
+
+	var wg sync.WaitGroup
+	for i, n := range list {
+		if !m.acquire() {
+			errs[i] = context.Cause(m.context())
+			continue
+		}
+
+		wg.Add(1)
+		go func(i, n int) {
+			defer wg.Done()
+			defer m.release()
+
+			pn, ok := nodes[n].(testbedi.Peers)
+			if !ok {
+				errs[i] = fmt.Errorf("node does not implement peers")
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(m.context(), timeout)
+			defer cancel()
+
+			errs[i] = execNetns(nw, nodes[n].Dir(), func() error {
+				var err error
+				peers[i], err = pn.Peers(ctx)
+				return err
+			})
+		}(i, n)
+	}
+	wg.Wait()
+
+	seen := make(map[topologyEdge]bool)
+	for i, n := range list {
+		id, _ := nodes[n].PeerID()
+		topo.Nodes = append(topo.Nodes, topologyNode{
+			Index:  n,
+			PeerID: id,
+		})
+
+		if errs[i] != nil {
+			topo.Errors[n] = errs[i].Error()
+			continue
+		}
+
+		for _, p := range peers[i] {
+			p = peerIDFromAddr(p)
+
+			m, ok := index[p]
+			if !ok {
+				topo.External = append(topo.External, topologyExternal{
+					From: n,
+					Peer: p,
+				})
+				continue
+			}
+
+			e := topologyEdge{n, m}
+			if m < n {
+				e = topologyEdge{m, n}
+			}
+
+			if !seen[e] {
+				seen[e] = true
+				topo.Edges = append(topo.Edges, e)
+			}
+		}
+	}
+
+	sort.Slice(topo.Edges, func(i, j int) bool {
+		a, b := topo.Edges[i], topo.Edges[j]
+		return a.From < b.From || (a.From == b.From && a.To < b.To)
+	})
+
+	return topo, nil
+}
+
+// diff compares the observed edges against the requested ones, ignoring
+// requested edges which involve nodes that were not inspected
+func (t *observedTopology) diff(requested [][2]int, list []int) {
+	inspected := make(map[int]bool)
+	for _, n := range list {
+		inspected[n] = true
+	}
+
+	observed := make(map[topologyEdge]bool)
+	for _, e := range t.Edges {
+		observed[e] = true
+	}
+
+	wanted := make(map[topologyEdge]bool)
+	for _, r := range requested {
+		e := topologyEdge{r[0], r[1]}
+		if !inspected[e.From] || !inspected[e.To] {
+			continue
+		}
+
+		wanted[e] = true
+		if !observed[e] {
+			t.Missing = append(t.Missing, e)
+		}
+	}
+
+	for _, e := range t.Edges {
+		if !wanted[e] {
+			t.Unexpected = append(t.Unexpected, e)
+		}
+	}
+}
+
+func (t *observedTopology) writeDot(w io.Writer) error {
+	var b strings.Builder
+
+	b.WriteString("graph testbed {\n")
+	for _, n := range t.Nodes {
+		attrs := fmt.Sprintf("label=%q", fmt.Sprintf("%d\n%s", n.Index, n.PeerID))
+		if err, ok := t.Errors[n.Index]; ok {
+			attrs += fmt.Sprintf(", color=orange, tooltip=%q", err)
+		}
+
+		fmt.Fprintf(&b, "  %d [%s];\n", n.Index, attrs)
+	}
+
+	unexpected := make(map[topologyEdge]bool)
+	for _, e := range t.Unexpected {
+		unexpected[e] = true
+	}
+
+	for _, e := range t.Edges {
+		if unexpected[e] {
+			fmt.Fprintf(&b, "  %d -- %d [color=blue, label=\"unexpected\"];\n", e.From, e.To)
+		} else {
+			fmt.Fprintf(&b, "  %d -- %d;\n", e.From, e.To)
+		}
+	}
+
+	for _, e := range t.Missing {
+		fmt.Fprintf(&b, "  %d -- %d [style=dotted, color=gray, label=\"missing\"];\n", e.From, e.To)
+	}
+
+	for _, e := range t.External {
+		fmt.Fprintf(&b, "  %d -- %q [style=dashed, color=red];\n", e.From, e.Peer)
+	}
+	b.WriteString("}\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (t *observedTopology) writeGraphML(w io.Writer) error {
+	var b strings.Builder
+
+	escape := func(s string) string {
+		var e strings.Builder
+		xml.EscapeText(&e, []byte(s))
+		return e.String()
+	}
+
+	b.WriteString(xml.Header)
+	b.WriteString(`<graphml xmlns="http://graphml.graphdrawing.org/xmlns">` + "\n")
+	b.WriteString(`  <key id="peer_id" for="node" attr.name="peer_id" attr.type="string"/>` + "\n")
+	b.WriteString(`  <key id="external" for="node" attr.name="external" attr.type="boolean"/>` + "\n")
+	b.WriteString(`  <key id="error" for="node" attr.name="error" attr.type="string"/>` + "\n")
+	b.WriteString(`  <key id="status" for="edge" attr.name="status" attr.type="string"/>` + "\n")
+	b.WriteString(`  <graph id="testbed" edgedefault="undirected">` + "\n")
+
+	for _, n := range t.Nodes {
+		fmt.Fprintf(&b, "    <node id=\"%d\">\n", n.Index)
+		fmt.Fprintf(&b, "      <data key=\"peer_id\">%s</data>\n", escape(n.PeerID))
+		if err, ok := t.Errors[n.Index]; ok {
+			fmt.Fprintf(&b, "      <data key=\"error\">%s</data>\n", escape(err))
+		}
+		b.WriteString("    </node>\n")
+	}
+
+	external := make(map[string]bool)
+	for _, e := range t.External {
+		if external[e.Peer] {
+			continue
+		}
+		external[e.Peer] = true
+
+		fmt.Fprintf(&b, "    <node id=\"%s\">\n", escape(e.Peer))
+		fmt.Fprintf(&b, "      <data key=\"peer_id\">%s</data>\n", escape(e.Peer))
+		b.WriteString("      <data key=\"external\">true</data>\n")
+		b.WriteString("    </node>\n")
+	}
+
+	unexpected := make(map[topologyEdge]bool)
+	for _, e := range t.Unexpected {
+		unexpected[e] = true
+	}
+
+	edge := func(from, to, status string) {
+		fmt.Fprintf(&b, "    <edge source=\"%s\" target=\"%s\">\n", from, to)
+		fmt.Fprintf(&b, "      <data key=\"status\">%s</data>\n", status)
+		b.WriteString("    </edge>\n")
+	}
+
+	for _, e := range t.Edges {
+		status := "observed"
+		if unexpected[e] {
+			status = "unexpected"
+		}
+		edge(fmt.Sprint(e.From), fmt.Sprint(e.To), status)
+	}
+
+	for _, e := range t.Missing {
+		edge(fmt.Sprint(e.From), fmt.Sprint(e.To), "missing")
+	}
+
+	for _, e := range t.External {
+		edge(fmt.Sprint(e.From), escape(e.Peer), "external")
+	}
+
+	b.WriteString("  </graph>\n")
+	b.WriteString("</graphml>\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// recordTopology adds edges to the connections requested between nodes, or
+// removes them when add is false
+func recordTopology(tb testbed.BasicTestbed, edges []edge, add bool) error {
+	requested, err := testbed.ReadTopology(tb.Dir())
+	if err != nil {
+		return err
+	}
+
+	set := make(map[[2]int]bool)
+	for _, r := range requested {
+		set[r] = true
+	}
+
+	for _, e := range edges {
+		r := [2]int{e.From, e.To}
+		if r[1] < r[0] {
+			r = [2]int{e.To, e.From}
+		}
+
+		set[r] = add
+	}
+
+	var out [][2]int
+	for r, ok := range set {
+		if ok {
+			out = append(out, r)
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i][0] < out[j][0] || (out[i][0] == out[j][0] && out[i][1] < out[j][1])
+	})
+
+	return testbed.WriteTopology(tb.Dir(), out)
+}
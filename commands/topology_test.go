@@ -0,0 +1,31 @@
+package commands
+
+import (
+	"testing"
+)
+
+func TestPeerIDFromAddr(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected string
+	}{
+		{"QmPeer", "QmPeer"},
+		{"/ip4/127.0.0.1/tcp/4001/p2p/QmPeer", "QmPeer"},
+		{"/ip4/127.0.0.1/tcp/4001/ipfs/QmPeer", "QmPeer"},
+	}
+
+	for _, c := range cases {
+		expect(t, peerIDFromAddr(c.input), c.expected)
+	}
+}
+
+func TestTopologyDiff(t *testing.T) {
+	topo := &observedTopology{
+		Edges: []topologyEdge{{0, 1}, {1, 2}},
+	}
+
+	topo.diff([][2]int{{0, 1}, {0, 2}, {2, 3}}, []int{0, 1, 2})
+
+	expect(t, topo.Missing, []topologyEdge{{0, 2}})
+	expect(t, topo.Unexpected, []topologyEdge{{1, 2}})
+}
@@ -1,12 +1,15 @@
 package commands
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	testbedi "github.com/ipfs/iptb/testbed/interfaces"
 	cli "github.com/urfave/cli"
@@ -123,53 +126,92 @@ func expandDashRange(s string) ([]int, error) {
 }
 
 type Result struct {
-	Node   int
-	Output testbedi.Output
-	Error  error
+	Node     int
+	Output   testbedi.Output
+	Error    error
+	Duration time.Duration
+	// Ready is the time the node took to be ready, when it was waited for
+	Ready time.Duration
 }
 
-type outputFunc func(testbedi.Core) (testbedi.Output, error)
+// outputFunc is called for every node of a range, with the index of the node
+type outputFunc func(context.Context, int, testbedi.Core) (testbedi.Output, error)
+
+// mapper runs functions on many nodes at once, bounded by the global
+// --concurrency flag, and reports their progress. A nil mapper runs on every
+// node at once, without reporting.
+type mapper struct {
+	ctx     context.Context
+	timeout time.Duration
+	// cancel is set with --fail-fast, to cancel the remaining nodes once one
+	// failed
+	cancel   context.CancelCauseFunc
+	sem      chan struct{}
+	progress *progress
+	// w receives the nodes still pending when the context is cancelled
+	w io.Writer
+}
 
-func mapListWithOutput(ranges [][]int, nodes []testbedi.Core, fns []outputFunc) ([]Result, error) {
-	var wg sync.WaitGroup
-	var lk sync.Mutex
-	var errs []error
+// newMapper returns the mapper of a command. Every node runs under the root
+// context, limited by the --timeout flag of the command when it has one.
+func newMapper(c *cli.Context) (*mapper, error) {
+	timeout, err := ParseTimeout(c.String("timeout"))
+	if err != nil {
+		return nil, err
+	}
 
-	total := 0
-	offsets := make([]int, len(ranges))
-	for i, list := range ranges {
-		offsets[i] = total
-		total += len(list)
+	m := &mapper{
+		ctx:     rootContext(c),
+		timeout: timeout,
 	}
-	results := make([]Result, total)
 
-	for i, list := range ranges {
-		wg.Add(1)
-		go func(i int, list []int) {
-			defer wg.Done()
-			results_i, err := mapWithOutput(list, nodes, fns[i])
+	if c.GlobalBool("fail-fast") {
+		m.ctx, m.cancel = context.WithCancelCause(m.ctx)
+	}
 
-			lk.Lock()
-			defer lk.Unlock()
+	if n := c.GlobalInt("concurrency"); n > 0 {
+		m.sem = make(chan struct{}, n)
+	}
 
-			if err != nil {
-				errs = append(errs, err)
-			}
-			for j, result := range results_i {
-				results[offsets[i]+j] = result
-			}
-		}(i, list)
-		wg.Wait()
+	if !c.GlobalBool("quiet") {
+		m.progress = newProgress(c.App.ErrWriter, c.Command.Name)
+		m.w = c.App.ErrWriter
 	}
 
-	if len(errs) != 0 {
-		return results, cli.NewMultiError(errs...)
+	return m, nil
+}
+
+func (m *mapper) context() context.Context {
+	if m == nil || m.ctx == nil {
+		return context.Background()
 	}
 
-	return results, nil
+	return m.ctx
+}
+
+// acquire blocks until the concurrency limit allows another node to run. It
+// returns false when the context was cancelled first.
+func (m *mapper) acquire() bool {
+	ctx := m.context()
+	if m == nil || m.sem == nil || ctx.Err() != nil {
+		return ctx.Err() == nil
+	}
+
+	select {
+	case m.sem <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (m *mapper) release() {
+	if m != nil && m.sem != nil {
+		<-m.sem
+	}
 }
 
-func mapWithOutput(list []int, nodes []testbedi.Core, fn outputFunc) ([]Result, error) {
+func (m *mapper) mapWithOutput(list []int, nodes []testbedi.Core, fn outputFunc) ([]Result, error) {
 	var wg sync.WaitGroup
 	var lk sync.Mutex
 	results := make([]Result, len(list))
@@ -178,22 +220,87 @@ func mapWithOutput(list []int, nodes []testbedi.Core, fn outputFunc) ([]Result,
 		return results, err
 	}
 
+	ctx := m.context()
+
+	var p *progress
+	var timeout time.Duration
+	if m != nil {
+		p = m.progress
+		timeout = m.timeout
+	}
+
+	p.add(len(list))
+	defer p.release()
+
+	pending := make(map[int]bool)
+	for _, n := range list {
+		pending[n] = true
+	}
+
+	finished := make(chan struct{})
+	defer close(finished)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			lk.Lock()
+			defer lk.Unlock()
+
+			if m != nil && m.w != nil && len(pending) != 0 {
+				fmt.Fprintf(m.w, "%s, still pending: %s\n", context.Cause(ctx), formatPending(pending))
+			}
+		case <-finished:
+		}
+	}()
+
 	for i, n := range list {
+		if !m.acquire() {
+			lk.Lock()
+			results[i] = Result{
+				Node:  n,
+				Error: fmt.Errorf("node[%d]: not started: %w", n, context.Cause(ctx)),
+			}
+			lk.Unlock()
+			continue
+		}
+
 		wg.Add(1)
 		go func(i, n int, node testbedi.Core) {
 			defer wg.Done()
-			out, err := fn(node)
+			defer m.release()
+
+			nctx, cancel := withTimeout(ctx, timeout)
+			defer cancel()
+
+			p.start(n)
+			start := time.Now()
+			out, err := fn(nctx, n, node)
+
+			// Plugins may report a command killed by the context as a mere
+			// exit code
+			if err == nil && nctx.Err() != nil && (out == nil || out.ExitCode() != 0) {
+				err = context.Cause(nctx)
+			}
+
 			if err != nil {
 				err = fmt.Errorf("node[%d]: %w", n, err)
 			}
+			failed := err != nil || exitFailed(out)
+			p.finish(n, failed)
+
+			if failed && m != nil && m.cancel != nil {
+				m.cancel(fmt.Errorf("cancelled after node[%d] failed", n))
+			}
 
 			lk.Lock()
 			defer lk.Unlock()
 
+			delete(pending, n)
 			results[i] = Result{
-				Node:   n,
-				Output: out,
-				Error:  err,
+				Node:     n,
+				Output:   out,
+				Error:    err,
+				Duration: time.Since(start),
 			}
 		}(i, n, nodes[n])
 	}
@@ -204,9 +311,99 @@ func mapWithOutput(list []int, nodes []testbedi.Core, fn outputFunc) ([]Result,
 
 }
 
+func (m *mapper) pairTimeout() time.Duration {
+	if m == nil {
+		return 0
+	}
+
+	return m.timeout
+}
+
+// mapPairs runs fn on every pair of nodes, bounded by the concurrency and the
+// timeout of the mapper like mapWithOutput. Results are reported per pair,
+// under the node the pair starts from, with errors prefixed by both nodes
+// joined by arrow, e.g. node[0] => node[1].
+func (m *mapper) mapPairs(pairs [][2]int, arrow string, fn func(ctx context.Context, from, to int) error) []Result {
+	var wg sync.WaitGroup
+	results := make([]Result, len(pairs))
+
+	ctx := m.context()
+
+	var p *progress
+	if m != nil {
+		p = m.progress
+	}
+
+	p.add(len(pairs))
+	defer p.release()
+
+	for i, pair := range pairs {
+		if !m.acquire() {
+			results[i] = Result{
+				Node:  pair[0],
+				Error: fmt.Errorf("node[%d] %s node[%d]: not started: %w", pair[0], arrow, pair[1], context.Cause(ctx)),
+			}
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, pair [2]int) {
+			defer wg.Done()
+			defer m.release()
+
+			pctx, cancel := withTimeout(ctx, m.pairTimeout())
+			defer cancel()
+
+			p.start(pair[0])
+			start := time.Now()
+			err := fn(pctx, pair[0], pair[1])
+			p.finish(pair[0], err != nil)
+
+			if err != nil {
+				err = fmt.Errorf("node[%d] %s node[%d]: %w", pair[0], arrow, pair[1], err)
+
+				if m != nil && m.cancel != nil {
+					m.cancel(fmt.Errorf("cancelled after %w", err))
+				}
+			}
+
+			results[i] = Result{
+				Node:     pair[0],
+				Error:    err,
+				Duration: time.Since(start),
+			}
+		}(i, pair)
+	}
+
+	wg.Wait()
+
+	return results
+}
+
+// formatPending lists pending nodes in order, e.g. node[1] node[4]
+func formatPending(pending map[int]bool) string {
+	var list []int
+	for n := range pending {
+		list = append(list, n)
+	}
+
+	sort.Ints(list)
+
+	parts := make([]string, len(list))
+	for i, n := range list {
+		parts[i] = fmt.Sprintf("node[%d]", n)
+	}
+
+	return strings.Join(parts, " ")
+}
+
 func validRange(list []int, total int) error {
 	max := 0
 	for _, n := range list {
+		if n < 0 {
+			return fmt.Errorf("node range contains value (%d) outside of valid range [0-%d]", n, total-1)
+		}
+
 		if max < n {
 			max = n
 		}
@@ -219,17 +416,74 @@ func validRange(list []int, total int) error {
 	return nil
 }
 
-func buildReport(results []Result, quiet bool) error {
+// failures returns an error for every result which failed, either because
+// the plugin returned an error or because the command exited with a non-zero
+// code which was not expected
+func failures(results []Result) []error {
 	var errs []error
-
 	for _, rs := range results {
-		if rs.Error != nil {
+		switch {
+		case rs.Error != nil:
 			errs = append(errs, rs.Error)
+		case exitFailed(rs.Output):
+			errs = append(errs, fmt.Errorf("node[%d]: exit %d", rs.Node, rs.Output.ExitCode()))
+		}
+	}
+
+	return errs
+}
+
+// succeeded returns the nodes of results which did not fail
+func succeeded(results []Result) []int {
+	var list []int
+	for _, rs := range results {
+		if rs.Error == nil && !exitFailed(rs.Output) {
+			list = append(list, rs.Node)
 		}
+	}
+
+	return list
+}
+
+// checkFailures returns the failures of results as a single error, unless at
+// most allow of them failed
+func checkFailures(results []Result, allow int) error {
+	errs := failures(results)
+	if len(errs) == 0 || len(errs) <= allow {
+		return nil
+	}
+
+	return cli.NewMultiError(errs...)
+}
 
+// writeSummary prints how many results succeeded and failed
+func writeSummary(w io.Writer, results []Result) {
+	failed := len(failures(results))
+	fmt.Fprintf(w, "%d succeeded, %d failed\n", len(results)-failed, failed)
+}
+
+// buildReport prints the output of every result. It fails when more than
+// allow results failed.
+func buildReport(results []Result, quiet bool, format string, allow int) error {
+	if format == formatJSON || format == formatNDJSON {
+		records := make([]resultRecord, 0, len(results))
+		for _, rs := range results {
+			records = append(records, newResultRecord(rs))
+		}
+
+		if err := writeFormatted(os.Stdout, format, records, nil); err != nil {
+			return err
+		}
+
+		return checkFailures(results, allow)
+	}
+
+	for _, rs := range results {
 		if quiet {
-			io.Copy(os.Stdout, rs.Output.Stdout())
-			io.Copy(os.Stdout, rs.Output.Stderr())
+			if rs.Output != nil {
+				io.Copy(os.Stdout, rs.Output.Stdout())
+				io.Copy(os.Stdout, rs.Output.Stderr())
+			}
 			continue
 		}
 
@@ -249,9 +503,16 @@ func buildReport(results []Result, quiet bool) error {
 
 	}
 
-	if len(errs) != 0 {
-		return cli.NewMultiError(errs...)
+	if !quiet {
+		for _, rs := range results {
+			if rs.Ready != 0 {
+				fmt.Printf("node[%d] ready after %s\n", rs.Node, rs.Ready.Round(time.Millisecond))
+			}
+		}
+
+		// The summary goes to stderr, stdout only carries the output of nodes
+		writeSummary(os.Stderr, results)
 	}
 
-	return nil
+	return checkFailures(results, allow)
 }
@@ -1,12 +1,19 @@
 package commands
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"reflect"
 	"runtime"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	testbedi "github.com/ipfs/iptb/testbed/interfaces"
+	iptbutil "github.com/ipfs/iptb/util"
 )
 
 var (
@@ -57,6 +64,7 @@ func TestValidRange(t *testing.T) {
 	}{
 		{[]int{0, 1}, 2, nil},
 		{[]int{0, 3}, 2, buildError(3, 2)},
+		{[]int{0, -1}, 2, buildError(-1, 2)},
 	}
 
 	for _, c := range cases {
@@ -103,3 +111,121 @@ func TestParseAttrSlice(t *testing.T) {
 		expect(t, attrs, c.expectedAttrs)
 	}
 }
+
+func TestCheckFailures(t *testing.T) {
+	results := []Result{
+		{Node: 0, Output: iptbutil.NewOutput(nil, nil, nil, 0, nil)},
+		{Node: 1, Output: iptbutil.NewOutput(nil, nil, nil, 3, nil)},
+		{Node: 2, Error: fmt.Errorf("node[2]: failed")},
+	}
+
+	expect(t, checkFailures(results, 2), nil)
+
+	err := checkFailures(results, 1)
+	if err == nil {
+		t.Fatal("expected an error with more failures than allowed")
+	}
+
+	expect(t, err.Error(), "node[1]: exit 3\nnode[2]: failed")
+}
+
+func TestMapWithOutputConcurrency(t *testing.T) {
+	var lk sync.Mutex
+	running, most := 0, 0
+
+	nodes := newTestNodes(6, nil)
+	m := &mapper{
+		ctx:      context.Background(),
+		sem:      make(chan struct{}, 2),
+		progress: newProgress(io.Discard, "test"),
+	}
+
+	results, err := m.mapWithOutput([]int{0, 1, 2, 3, 4, 5}, nodes, func(ctx context.Context, n int, node testbedi.Core) (testbedi.Output, error) {
+		lk.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		lk.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		lk.Lock()
+		running--
+		lk.Unlock()
+
+		if n == 4 {
+			return nil, fmt.Errorf("failed")
+		}
+
+		return testOutput(nil, "", n%2), nil
+	})
+	expect(t, err, nil)
+
+	expect(t, most, 2)
+	expect(t, len(results), 6)
+	expect(t, results[4].Error.Error(), "node[4]: failed")
+
+	// Nodes which exited with an error count as failed
+	expect(t, m.progress.total, 6)
+	expect(t, m.progress.finished, 6)
+	expect(t, m.progress.failed, 4)
+	expect(t, len(m.progress.running), 0)
+}
+
+func TestMapPairs(t *testing.T) {
+	var lk sync.Mutex
+	running, most := 0, 0
+
+	m := &mapper{ctx: context.Background(), sem: make(chan struct{}, 2)}
+	pairs := [][2]int{{0, 1}, {0, 2}, {1, 2}, {2, 0}}
+
+	results := m.mapPairs(pairs, "=>", func(ctx context.Context, from, to int) error {
+		lk.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		lk.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		lk.Lock()
+		running--
+		lk.Unlock()
+
+		if to == 0 {
+			return fmt.Errorf("refused")
+		}
+
+		return nil
+	})
+
+	expect(t, most, 2)
+	expect(t, len(results), 4)
+	expect(t, results[0].Error, nil)
+	expect(t, results[3].Node, 2)
+	expect(t, results[3].Error.Error(), "node[2] => node[0]: refused")
+}
+
+func TestMapPairsTimeout(t *testing.T) {
+	m := &mapper{ctx: context.Background(), timeout: 10 * time.Millisecond}
+
+	results := m.mapPairs([][2]int{{0, 1}}, "=/>", func(ctx context.Context, from, to int) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	expect(t, results[0].Error.Error(), "node[0] =/> node[1]: context deadline exceeded")
+}
+
+func TestSucceeded(t *testing.T) {
+	results := []Result{
+		{Node: 0},
+		{Node: 1, Error: fmt.Errorf("down")},
+		{Node: 2, Output: testOutput(nil, "", 1)},
+		{Node: 3, Output: testOutput(nil, "", 0)},
+	}
+
+	expect(t, succeeded(results), []int{0, 3})
+}
@@ -0,0 +1,198 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sync"
+	"time"
+
+	cli "github.com/urfave/cli"
+
+	"github.com/ipfs/iptb/testbed"
+	testbedi "github.com/ipfs/iptb/testbed/interfaces"
+	"github.com/ipfs/iptb/testbed/netns"
+)
+
+var WaitCmd = cli.Command{
+	Category:  "CORE",
+	Name:      "wait",
+	Usage:     "wait for specified nodes (or all) to be ready",
+	ArgsUsage: "[nodes]",
+	Description: `
+The wait command waits until nodes are ready to accept commands, asking them
+every --interval. Nodes which are not ready within --timeout fail.
+
+$ iptb wait --ready [0-3]
+
+Readiness is defined by the plugin, which must implement it. The same check
+is used by start --wait and restart --wait.
+`,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "ready",
+			Usage: "wait for nodes to be ready",
+		},
+		cli.StringFlag{
+			Name:  "interval",
+			Usage: "delay between two readiness checks",
+			Value: "500ms",
+		},
+		cli.StringFlag{
+			Name:  "timeout",
+			Usage: "maximum duration of the wait on every node",
+			Value: "60s",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		flagRoot := c.GlobalString("IPTB_ROOT")
+		flagTestbed := c.GlobalString("testbed")
+		flagQuiet := c.GlobalBool("quiet")
+		flagFormat := c.GlobalString("format")
+		flagAllowFailures := c.GlobalInt("allow-failures")
+		flagInterval := c.String("interval")
+
+		if !c.Bool("ready") {
+			return NewUsageError("wait requires a condition, e.g. --ready")
+		}
+
+		interval, err := time.ParseDuration(flagInterval)
+		if err != nil {
+			return NewUsageError(fmt.Sprintf("invalid interval %s: %s", flagInterval, err))
+		}
+
+		tb := testbed.NewTestbed(path.Join(flagRoot, "testbeds", flagTestbed))
+		nodes, err := tb.Nodes()
+		if err != nil {
+			return err
+		}
+
+		nodeRange := c.Args().First()
+
+		if nodeRange == "" {
+			nodeRange = fmt.Sprintf("[0-%d]", len(nodes)-1)
+		}
+
+		list, err := parseRange(nodeRange)
+		if err != nil {
+			return fmt.Errorf("could not parse node range %s", nodeRange)
+		}
+
+		// The timeout of the mapper bounds the wait on every node
+		r := newReadiness(interval, 0)
+
+		runCmd := func(ctx context.Context, n int, node testbedi.Core) (testbedi.Output, error) {
+			return nil, r.wait(ctx, n, node, time.Now())
+		}
+
+		nw, err := netns.Load(tb.Dir())
+		if err != nil {
+			return err
+		}
+
+		m, err := newMapper(c)
+		if err != nil {
+			return err
+		}
+
+		results, err := m.mapWithOutput(list, nodes, inNetns(nw, runCmd))
+		if err != nil {
+			return err
+		}
+
+		if flagFormat != formatText {
+			records := make([]waitRecord, 0, len(results))
+			for _, rs := range results {
+				records = append(records, newWaitRecord(rs, r.attempts[rs.Node]))
+			}
+
+			if err := writeFormatted(c.App.Writer, flagFormat, records, nil); err != nil {
+				return err
+			}
+		} else if !flagQuiet {
+			waitReport(c.App.Writer, c.App.ErrWriter, results, r.attempts, "ready")
+		}
+
+		return checkFailures(results, flagAllowFailures)
+	},
+}
+
+var errNotReady = errors.New("not ready")
+
+// Defaults of the readiness checks made when nodes are started
+const (
+	readyInterval = 250 * time.Millisecond
+	readyTimeout  = time.Minute
+)
+
+// readiness waits for nodes to be ready, and records how long it took
+type readiness struct {
+	interval time.Duration
+	timeout  time.Duration
+
+	lk       sync.Mutex
+	ready    map[int]time.Duration
+	attempts map[int]int
+}
+
+func newReadiness(interval, timeout time.Duration) *readiness {
+	return &readiness{
+		interval: interval,
+		timeout:  timeout,
+		ready:    make(map[int]time.Duration),
+		attempts: make(map[int]int),
+	}
+}
+
+// start starts a node, and waits for it to be ready when wait is set. Nodes
+// which do not implement Readiness are left to wait on their own in Start.
+func (r *readiness) start(ctx context.Context, n int, node testbedi.Core, wait bool, args []string) (testbedi.Output, error) {
+	_, probe := node.(testbedi.Readiness)
+
+	begin := time.Now()
+	out, err := node.Start(ctx, wait && !probe, args...)
+	if err != nil || !wait || !probe {
+		return out, err
+	}
+
+	return out, r.wait(ctx, n, node, begin)
+}
+
+// wait checks whether a node is ready every interval, until it is or the
+// timeout elapsed. The time it took since begin is recorded.
+func (r *readiness) wait(ctx context.Context, n int, node testbedi.Core, begin time.Time) error {
+	probe, ok := node.(testbedi.Readiness)
+	if !ok {
+		return fmt.Errorf("node does not implement readiness")
+	}
+
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	_, attempts, err := poll(ctx, r.interval, func(ctx context.Context) (testbedi.Output, error) {
+		ready, err := probe.Ready(ctx)
+		if err == nil && !ready {
+			err = errNotReady
+		}
+
+		return nil, err
+	})
+
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	r.attempts[n] = attempts
+	if err == nil {
+		r.ready[n] = time.Since(begin)
+	}
+
+	return err
+}
+
+// record sets the time every node took to be ready on its result
+func (r *readiness) record(results []Result) {
+	for i, rs := range results {
+		results[i].Ready = r.ready[rs.Node]
+	}
+}
@@ -0,0 +1,83 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	testbedi "github.com/ipfs/iptb/testbed/interfaces"
+)
+
+// startNode is a node which records whether Start was asked to wait
+type startNode struct {
+	*testNode
+	waited []bool
+}
+
+func (n *startNode) Start(ctx context.Context, wait bool, args ...string) (testbedi.Output, error) {
+	n.waited = append(n.waited, wait)
+	return nil, nil
+}
+
+// readyNode is a node which is ready once it was probed more than after
+// times, or never when after is negative
+type readyNode struct {
+	startNode
+	after int
+	calls int
+}
+
+func (n *readyNode) Ready(ctx context.Context) (bool, error) {
+	n.calls++
+	return n.after >= 0 && n.calls > n.after, nil
+}
+
+func TestReadinessReady(t *testing.T) {
+	node := &readyNode{startNode: startNode{testNode: &testNode{}}, after: 2}
+	r := newReadiness(time.Millisecond, time.Second)
+
+	_, err := r.start(context.Background(), 0, node, true, nil)
+	expect(t, err, nil)
+
+	// Nodes which can be probed are not left to wait in Start
+	expect(t, node.waited, []bool{false})
+	expect(t, r.attempts[0], 3)
+
+	results := []Result{{Node: 0}}
+	r.record(results)
+	if results[0].Ready <= 0 {
+		t.Errorf("expected the time node[0] took to be ready, got %s", results[0].Ready)
+	}
+}
+
+func TestReadinessTimeout(t *testing.T) {
+	node := &readyNode{startNode: startNode{testNode: &testNode{}}, after: -1}
+	r := newReadiness(time.Millisecond, 20*time.Millisecond)
+
+	err := r.wait(context.Background(), 0, node, time.Now())
+	if !errors.Is(err, errNotReady) {
+		t.Fatalf("expected a node which is not ready, got %v", err)
+	}
+
+	_, ok := r.ready[0]
+	expect(t, ok, false)
+
+	if r.attempts[0] < 2 {
+		t.Errorf("expected node[0] to be probed until the timeout, got %d attempts", r.attempts[0])
+	}
+}
+
+func TestReadinessNotImplemented(t *testing.T) {
+	node := &startNode{testNode: &testNode{}}
+	r := newReadiness(time.Millisecond, time.Second)
+
+	err := r.wait(context.Background(), 0, node, time.Now())
+	expect(t, err.Error(), "node does not implement readiness")
+
+	// Start waits on its own for nodes which can not be probed
+	_, err = r.start(context.Background(), 0, node, true, nil)
+	expect(t, err, nil)
+	expect(t, node.waited, []bool{true})
+	expect(t, len(r.attempts), 0)
+}
@@ -0,0 +1,205 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sync"
+	"time"
+
+	cli "github.com/urfave/cli"
+
+	"github.com/ipfs/iptb/testbed"
+	testbedi "github.com/ipfs/iptb/testbed/interfaces"
+)
+
+var WaitEventCmd = cli.Command{
+	Category:  "CORE",
+	Name:      "wait-event",
+	Usage:     "wait for specified nodes (or all) to emit an event",
+	ArgsUsage: "[nodes]",
+	Description: `
+The wait-event command reads the event streams of nodes until every node
+emitted an event matching --match, and prints the events which matched.
+--match is either a regular expression or a json path=value:
+
+$ iptb wait-event --match '.type="bootstrap"' --timeout 30s [0-3]
+14:02:11.207 [node 2] {"type":"bootstrap","peers":4}
+...
+4 of 4 nodes matched after 1.532s
+
+With --quorum, the wait is over once that many nodes emitted a matching event.
+Nodes which did not match within --timeout fail, unless the quorum was met.
+`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "match",
+			Usage: "regex or json path=value of the event to wait for",
+		},
+		cli.StringFlag{
+			Name:  "type",
+			Usage: "comma separated types of the event to wait for",
+		},
+		cli.StringFlag{
+			Name:  "timeout",
+			Usage: "maximum duration of the wait",
+			Value: "60s",
+		},
+		cli.IntFlag{
+			Name:  "quorum",
+			Usage: "number of nodes whose match ends the wait, all when 0",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		flagRoot := c.GlobalString("IPTB_ROOT")
+		flagTestbed := c.GlobalString("testbed")
+		flagQuiet := c.GlobalBool("quiet")
+		flagFormat := c.GlobalString("format")
+		flagAllowFailures := c.GlobalInt("allow-failures")
+		flagMatch := c.String("match")
+		flagType := c.String("type")
+		flagQuorum := c.Int("quorum")
+
+		if flagMatch == "" && flagType == "" {
+			return NewUsageError("wait-event requires --match or --type")
+		}
+
+		filter, err := newEventFilter(flagType, flagMatch)
+		if err != nil {
+			return err
+		}
+
+		timeout, err := ParseTimeout(c.String("timeout"))
+		if err != nil {
+			return err
+		}
+
+		tb := testbed.NewTestbed(path.Join(flagRoot, "testbeds", flagTestbed))
+		nodes, err := tb.Nodes()
+		if err != nil {
+			return err
+		}
+
+		nodeRange := c.Args().First()
+
+		if nodeRange == "" {
+			nodeRange = fmt.Sprintf("[0-%d]", len(nodes)-1)
+		}
+
+		list, err := parseRange(nodeRange)
+		if err != nil {
+			return fmt.Errorf("could not parse node range %s", nodeRange)
+		}
+
+		if err := validRange(list, len(nodes)); err != nil {
+			return err
+		}
+
+		quorum := len(list)
+		if flagQuorum < 0 || flagQuorum > len(list) {
+			return NewUsageError(fmt.Sprintf("invalid quorum %d, expected at most %d nodes", flagQuorum, len(list)))
+		} else if flagQuorum > 0 {
+			quorum = flagQuorum
+		}
+
+		ctx, cancel := withTimeout(rootContext(c), timeout)
+		defer cancel()
+
+		emit := func(ev nodeEvent) {
+			if flagQuiet {
+				return
+			}
+
+			switch flagFormat {
+			case formatNDJSON:
+				json.NewEncoder(c.App.Writer).Encode(ev)
+			case formatText:
+				fmt.Fprintf(c.App.Writer, "%s [node %d] %s\n", ev.Time.Format("15:04:05.000"), ev.Node, ev.Line)
+			}
+		}
+
+		lost := func(n int, err error) {
+			if !flagQuiet {
+				fmt.Fprintf(c.App.ErrWriter, "node[%d]: event stream lost: %s\n", n, err)
+			}
+		}
+
+		start := time.Now()
+		results, events, reached := waitEvents(ctx, list, nodes, filter, quorum, emit, lost)
+		elapsed := time.Since(start)
+
+		if flagFormat == formatJSON {
+			if events == nil {
+				events = []nodeEvent{}
+			}
+
+			if err := writeFormatted(c.App.Writer, flagFormat, events, nil); err != nil {
+				return err
+			}
+		} else if flagFormat == formatText && !flagQuiet {
+			fmt.Fprintf(c.App.Writer, "%d of %d nodes matched after %s\n", len(events), len(list), elapsed.Round(time.Millisecond))
+		}
+
+		if reached {
+			return nil
+		}
+
+		return checkFailures(results, flagAllowFailures)
+	},
+}
+
+// waitEvents reads the event streams of the nodes of list until quorum nodes
+// emitted an event matching filter, or until ctx is done. The first event
+// matching on every node is passed to emit, and streams which fail to lost. It
+// returns the result of every node, the events which matched, and whether the
+// quorum was met. Nodes without a match fail, unless the quorum was met.
+func waitEvents(ctx context.Context, list []int, nodes []testbedi.Core, filter eventFilter, quorum int, emit func(nodeEvent), lost func(int, error)) ([]Result, []nodeEvent, bool) {
+	ctx, done := context.WithCancel(ctx)
+	defer done()
+
+	var lk sync.Mutex
+	matched := make(map[int]bool)
+	var events []nodeEvent
+
+	results := streamEvents(ctx, list, nodes, func(ev nodeEvent) bool {
+		if !filter.match(ev) {
+			return true
+		}
+
+		lk.Lock()
+		defer lk.Unlock()
+
+		// Nodes keep streaming until the stream is closed, matches past the
+		// quorum are left out
+		if len(matched) >= quorum {
+			return false
+		}
+
+		matched[ev.Node] = true
+		events = append(events, ev)
+		emit(ev)
+
+		if len(matched) == quorum {
+			done()
+		}
+
+		return false
+	}, lost)
+
+	reached := len(matched) >= quorum
+
+	for i, rs := range results {
+		if matched[rs.Node] || rs.Error != nil || reached {
+			continue
+		}
+
+		if ctx.Err() != nil {
+			results[i].Error = fmt.Errorf("node[%d]: no matching event: %w", rs.Node, context.Cause(ctx))
+		} else {
+			results[i].Error = fmt.Errorf("node[%d]: event stream ended without a matching event", rs.Node)
+		}
+	}
+
+	return results, events, reached
+}
@@ -0,0 +1,102 @@
+package commands
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	testbedi "github.com/ipfs/iptb/testbed/interfaces"
+)
+
+// testEvents returns a stream of lines which stays open until it is closed
+func testEvents(lines ...string) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		pr, pw := io.Pipe()
+		go func() {
+			for _, line := range lines {
+				if _, err := io.WriteString(pw, line+"\n"); err != nil {
+					return
+				}
+			}
+		}()
+
+		return pr, nil
+	}
+}
+
+// testEventNodes returns a node per stream of events
+func testEventNodes(streams ...func() (io.ReadCloser, error)) []testbedi.Core {
+	var nodes []testbedi.Core
+	for i, events := range streams {
+		nodes = append(nodes, &testNode{index: i, events: events})
+	}
+
+	return nodes
+}
+
+func waitTestEvents(t *testing.T, nodes []testbedi.Core, quorum int, timeout time.Duration) ([]Result, []nodeEvent, bool) {
+	filter, err := newEventFilter("bootstrap", "")
+	expect(t, err, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	list := make([]int, len(nodes))
+	for i := range list {
+		list[i] = i
+	}
+
+	var emitted int
+	results, events, reached := waitEvents(ctx, list, nodes, filter, quorum, func(ev nodeEvent) {
+		emitted++
+	}, func(int, error) {})
+
+	expect(t, emitted, len(events))
+	return results, events, reached
+}
+
+func TestWaitEventsQuorum(t *testing.T) {
+	nodes := testEventNodes(
+		testEvents(`{"type":"tick"}`, `{"type":"bootstrap"}`),
+		testEvents(`{"type":"tick"}`),
+		testEvents(`{"type":"bootstrap"}`),
+	)
+
+	results, events, reached := waitTestEvents(t, nodes, 2, 5*time.Second)
+
+	expect(t, reached, true)
+	expect(t, len(events), 2)
+	expect(t, checkFailures(results, 0), nil)
+}
+
+func TestWaitEventsTimeout(t *testing.T) {
+	nodes := testEventNodes(
+		testEvents(`{"type":"bootstrap"}`),
+		testEvents(`{"type":"tick"}`),
+	)
+
+	results, events, reached := waitTestEvents(t, nodes, 2, 50*time.Millisecond)
+
+	expect(t, reached, false)
+	expect(t, len(events), 1)
+	expect(t, results[0].Error, nil)
+	expect(t, strings.Contains(results[1].Error.Error(), "node[1]: no matching event"), true)
+}
+
+func TestWaitEventsStreamEnded(t *testing.T) {
+	nodes := testEventNodes(
+		testEvents(`{"type":"bootstrap"}`),
+		func() (io.ReadCloser, error) {
+			return io.NopCloser(strings.NewReader(`{"type":"tick"}` + "\n")), nil
+		},
+	)
+
+	results, events, reached := waitTestEvents(t, nodes, 2, 5*time.Second)
+
+	expect(t, reached, false)
+	expect(t, len(events), 1)
+	expect(t, results[0].Error, nil)
+	expect(t, results[1].Error.Error(), "node[1]: event stream ended without a matching event")
+}
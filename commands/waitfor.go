@@ -0,0 +1,224 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"sync"
+	"time"
+
+	cli "github.com/urfave/cli"
+
+	"github.com/ipfs/iptb/testbed"
+	testbedi "github.com/ipfs/iptb/testbed/interfaces"
+	"github.com/ipfs/iptb/testbed/netns"
+)
+
+var WaitForCmd = cli.Command{
+	Category:  "CORE",
+	Name:      "wait-for",
+	Usage:     "run a command on specified nodes (or all) until it succeeds",
+	ArgsUsage: "[nodes] -- <command...>",
+	Description: `
+The wait-for command runs a command on every node every --interval, until it
+exits with 0 or, with --match, until its stdout matches a regex whatever its
+exit code. Nodes which do not satisfy the condition within --timeout fail.
+
+$ iptb wait-for -- ipfs id
+$ iptb wait-for --match 'Qm' [1-3] -- ipfs dht findprovs <cid>
+
+Arguments are expanded as templates, like with run. The time it took every
+node to satisfy the condition is printed once all nodes are done.
+`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "interval",
+			Usage: "delay between two runs of the command",
+			Value: "500ms",
+		},
+		cli.StringFlag{
+			Name:  "timeout",
+			Usage: "maximum duration of the wait on every node",
+			Value: "60s",
+		},
+		cli.StringFlag{
+			Name:  "match",
+			Usage: "wait for stdout to match this regex, rather than for exit 0",
+		},
+		cli.BoolFlag{
+			Name:  "no-template",
+			Usage: "pass arguments as is, without expanding templates",
+		},
+		cli.BoolFlag{
+			Name:   "terminator",
+			Hidden: true,
+		},
+	},
+	Before: func(c *cli.Context) error {
+		if present := isTerminatorPresent(c); present {
+			return c.Set("terminator", "true")
+		}
+		return nil
+	},
+	Action: func(c *cli.Context) error {
+		flagRoot := c.GlobalString("IPTB_ROOT")
+		flagTestbed := c.GlobalString("testbed")
+		flagQuiet := c.GlobalBool("quiet")
+		flagFormat := c.GlobalString("format")
+		flagAllowFailures := c.GlobalInt("allow-failures")
+		flagInterval := c.String("interval")
+		flagMatch := c.String("match")
+		flagNoTemplate := c.Bool("no-template")
+
+		interval, err := time.ParseDuration(flagInterval)
+		if err != nil {
+			return NewUsageError(fmt.Sprintf("invalid interval %s: %s", flagInterval, err))
+		}
+
+		expect := &expectation{Exit: new(int)}
+		if flagMatch != "" {
+			re, err := compileOutputRegexp(flagMatch)
+			if err != nil {
+				return NewUsageError(fmt.Sprintf("invalid --match: %s", err))
+			}
+
+			expect = &expectation{Stdout: re, AnyExit: true}
+		}
+
+		tb := testbed.NewTestbed(path.Join(flagRoot, "testbeds", flagTestbed))
+		nodes, err := tb.Nodes()
+		if err != nil {
+			return err
+		}
+
+		nodeRange, args := parseCommand(c.Args(), c.IsSet("terminator"))
+		if len(args) == 0 {
+			return NewUsageError("wait-for requires a command")
+		}
+
+		if nodeRange == "" {
+			nodeRange = fmt.Sprintf("[0-%d]", len(nodes)-1)
+		}
+
+		list, err := parseRange(nodeRange)
+		if err != nil {
+			return fmt.Errorf("could not parse node range %s", nodeRange)
+		}
+
+		templates, err := newNodeTemplates(tb)
+		if err != nil {
+			return err
+		}
+
+		nw, err := netns.Load(tb.Dir())
+		if err != nil {
+			return err
+		}
+
+		var lk sync.Mutex
+		attempts := make(map[int]int)
+
+		runCmd := func(ctx context.Context, n int, node testbedi.Core) (testbedi.Output, error) {
+			expanded := args
+			if !flagNoTemplate {
+				var err error
+				expanded, err = templates.expandAll(n, args)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			out, count, err := poll(ctx, interval, func(ctx context.Context) (testbedi.Output, error) {
+				out, err := node.RunCmd(ctx, nil, expanded...)
+				if err != nil {
+					return out, err
+				}
+
+				return expect.check(out)
+			})
+
+			lk.Lock()
+			attempts[n] = count
+			lk.Unlock()
+
+			return out, err
+		}
+
+		m, err := newMapper(c)
+		if err != nil {
+			return err
+		}
+
+		results, err := m.mapWithOutput(list, nodes, inNetns(nw, runCmd))
+		if err != nil {
+			return err
+		}
+
+		if flagFormat != formatText {
+			records := make([]waitRecord, 0, len(results))
+			for _, rs := range results {
+				records = append(records, newWaitRecord(rs, attempts[rs.Node]))
+			}
+
+			if err := writeFormatted(c.App.Writer, flagFormat, records, nil); err != nil {
+				return err
+			}
+		} else if !flagQuiet {
+			waitReport(c.App.Writer, c.App.ErrWriter, results, attempts, "satisfied")
+		}
+
+		return checkFailures(results, flagAllowFailures)
+	},
+}
+
+// poll calls fn every interval until it succeeds, or until ctx is done. It
+// returns the last output of fn and the number of attempts made.
+func poll(ctx context.Context, interval time.Duration, fn func(context.Context) (testbedi.Output, error)) (testbedi.Output, int, error) {
+	for attempts := 1; ; attempts++ {
+		out, err := fn(ctx)
+		if err == nil {
+			return out, attempts, nil
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return out, attempts, fmt.Errorf("not satisfied after %d attempts: %w", attempts, err)
+		}
+	}
+}
+
+// waitRecord is the machine readable form of the wait on a node
+type waitRecord struct {
+	Node      int          `json:"node"`
+	Satisfied bool         `json:"satisfied"`
+	Attempts  int          `json:"attempts"`
+	AfterMs   float64      `json:"after_ms"`
+	Error     *ErrorRecord `json:"error"`
+}
+
+func newWaitRecord(rs Result, attempts int) waitRecord {
+	return waitRecord{
+		Node:      rs.Node,
+		Satisfied: rs.Error == nil,
+		Attempts:  attempts,
+		AfterMs:   durationMs(rs.Duration),
+		Error:     NewErrorRecord(rs.Error),
+	}
+}
+
+// waitReport prints to w when every node met the condition, e.g. satisfied or
+// ready, and a summary to errw
+func waitReport(w, errw io.Writer, results []Result, attempts map[int]int, condition string) {
+	for _, rs := range results {
+		if rs.Error != nil {
+			fmt.Fprintf(w, "node[%d] never %s after %s\n", rs.Node, condition, rs.Duration.Round(time.Millisecond))
+			continue
+		}
+
+		fmt.Fprintf(w, "node[%d] %s after %s (%d attempts)\n", rs.Node, condition, rs.Duration.Round(time.Millisecond), attempts[rs.Node])
+	}
+
+	writeSummary(errw, results)
+}
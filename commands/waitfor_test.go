@@ -0,0 +1,47 @@
+package commands
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	testbedi "github.com/ipfs/iptb/testbed/interfaces"
+)
+
+func TestWaitForMatchAnyExit(t *testing.T) {
+	re, err := compileOutputRegexp("^found$")
+	expect(t, err, nil)
+
+	e := &expectation{Stdout: re, AnyExit: true}
+
+	var calls int32
+	nodes := newTestNodes(2, func(ctx context.Context, stdin io.Reader, args []string) (testbedi.Output, error) {
+		if atomic.AddInt32(&calls, 1) <= 2 {
+			return testOutput(args, "searching\n", 1), nil
+		}
+
+		return testOutput(args, "found\n", 1), nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	m := &mapper{ctx: ctx}
+	results, err := m.mapWithOutput([]int{0, 1}, nodes, func(ctx context.Context, n int, node testbedi.Core) (testbedi.Output, error) {
+		out, _, err := poll(ctx, time.Millisecond, func(ctx context.Context) (testbedi.Output, error) {
+			out, err := node.RunCmd(ctx, nil)
+			if err != nil {
+				return out, err
+			}
+
+			return e.check(out)
+		})
+
+		return out, err
+	})
+
+	expect(t, err, nil)
+	expect(t, checkFailures(results, 0), nil)
+}
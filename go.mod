@@ -3,6 +3,8 @@ module github.com/ipfs/iptb
 require (
 	github.com/mattn/go-shellwords v1.0.12
 	github.com/urfave/cli v1.22.16
+	golang.org/x/sys v0.9.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -1,17 +1,21 @@
 package main
 
 import (
-	"fmt"
+	"context"
 	"os"
 
 	"github.com/ipfs/iptb/cli"
+	"github.com/ipfs/iptb/commands"
 )
 
 func main() {
 	cli := cli.NewCli()
 
 	if err := cli.Run(os.Args); err != nil {
-		fmt.Fprintf(cli.ErrWriter, "%s\n", err)
-		os.Exit(1)
+		format, _ := cli.Metadata["format"].(string)
+		commands.WriteError(cli.ErrWriter, format, err)
+
+		ctx, _ := cli.Metadata["context"].(context.Context)
+		os.Exit(commands.ExitCode(ctx, err))
 	}
 }
@@ -32,6 +32,12 @@ type Libp2p interface {
 	SwarmAddrs() ([]string, error)
 }
 
+// Peers is implemented by nodes which can list the peers they are connected to
+type Peers interface {
+	// Peers returns the peer ids of the connected peers
+	Peers(ctx context.Context) ([]string, error)
+}
+
 type Config interface {
 	// Config returns the configuration of the node
 	Config() (interface{}, error)
@@ -110,6 +116,55 @@ type Metric interface {
 	*/
 }
 
+// Streamer is implemented by nodes which can run commands while streaming
+// their output, rather than buffering it until the command exits
+type Streamer interface {
+	// RunCmdStream runs a command in the context of the node, writing its
+	// output to stdout and stderr as it is produced. The returned Output
+	// does not need to hold stdout and stderr.
+	RunCmdStream(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer, args ...string) (Output, error)
+}
+
+// Readiness is implemented by nodes which can tell whether they are ready to
+// accept commands
+type Readiness interface {
+	// Ready reports whether the node is ready. It returns false rather than
+	// an error while the node is still starting.
+	Ready(ctx context.Context) (bool, error)
+}
+
+// Process is implemented by nodes running as a local process, whose resource
+// usage can be read from /proc
+type Process interface {
+	// PID returns the process id of the node, or an error when it is not
+	// running
+	PID() (int, error)
+}
+
+// Binder is implemented by nodes whose addresses can be moved off loopback,
+// which is required to place them in network namespaces
+type Binder interface {
+	// Bind makes the swarm and the api of the node listen on ip, from its
+	// next init or start. An empty ip restores the default addresses.
+	Bind(ip string) error
+}
+
+// Disconnector is implemented by nodes which can close their connections to
+// other nodes
+type Disconnector interface {
+	// Disconnect closes the connections of the node to n
+	Disconnect(ctx context.Context, n Core) error
+}
+
+// Filter is implemented by nodes which can refuse to communicate with other
+// nodes, for instance through swarm address filters
+type Filter interface {
+	// Block prevents the node from communicating with n
+	Block(ctx context.Context, n Core) error
+	// Unblock allows the node to communicate with n again
+	Unblock(ctx context.Context, n Core) error
+}
+
 // Core specifies the interface to a process controlled by iptb
 type Core interface {
 	Libp2p
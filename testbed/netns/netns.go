@@ -0,0 +1,209 @@
+package netns
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// StateFile is the name of the file, within the testbed directory, which
+// records the network created for the testbed
+const StateFile = "netns.json"
+
+// ErrNotSupported is returned on platforms without network namespaces
+var ErrNotSupported = errors.New("network namespaces are only supported on linux")
+
+// Shape describes the traffic shaping applied to a node or a link. Values use
+// the units understood by tc, e.g. `50ms`, `10mbit` or `0.5%`.
+type Shape struct {
+	Latency   string `json:"latency,omitempty"`
+	Jitter    string `json:"jitter,omitempty"`
+	Bandwidth string `json:"bandwidth,omitempty"`
+	Loss      string `json:"loss,omitempty"`
+}
+
+// Empty reports whether the shape does not alter traffic at all
+func (s Shape) Empty() bool {
+	return s == Shape{}
+}
+
+// Node is a network namespace, and the veth pair attaching it to the bridge
+type Node struct {
+	Index int    `json:"index"`
+	Dir   string `json:"dir"`
+	Netns string `json:"netns"`
+	Veth  string `json:"veth"`
+	Addr  string `json:"addr"`
+	Shape Shape  `json:"shape"`
+}
+
+// Link shapes the traffic sent from one node to another
+type Link struct {
+	From  int   `json:"from"`
+	To    int   `json:"to"`
+	Shape Shape `json:"shape"`
+}
+
+// Network represents every namespace, interface and bridge created for a
+// testbed
+type Network struct {
+	Bridge  string  `json:"bridge"`
+	Subnet  string  `json:"subnet"`
+	Gateway string  `json:"gateway"`
+	Nodes   []*Node `json:"nodes"`
+	Links   []*Link `json:"links,omitempty"`
+}
+
+// New lays out a network for the nodes stored in `dirs`, numbering addresses
+// from `subnet`. Nothing is created on the host until Setup is called.
+func New(tbdir string, dirs []string, subnet string) (*Network, error) {
+	ip, ipnet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil, err
+	}
+
+	ip = ip.To4()
+	if ip == nil {
+		return nil, fmt.Errorf("subnet %s is not an IPv4 subnet", subnet)
+	}
+
+	ones, bits := ipnet.Mask.Size()
+	if (1<<uint(bits-ones))-2 < len(dirs)+1 {
+		return nil, fmt.Errorf("subnet %s too small for %d nodes", subnet, len(dirs))
+	}
+
+	// Interface names are limited to 15 characters, so names are derived
+	// from a short hash of the testbed directory
+	sum := sha256.Sum256([]byte(tbdir))
+	prefix := fmt.Sprintf("ib%x", sum[:3])
+
+	base := binary.BigEndian.Uint32(ipnet.IP.To4())
+	addr := func(n uint32) string {
+		b := make(net.IP, 4)
+		binary.BigEndian.PutUint32(b, base+n)
+		return fmt.Sprintf("%s/%d", b, ones)
+	}
+
+	nw := &Network{
+		Bridge:  prefix + "br",
+		Subnet:  subnet,
+		Gateway: addr(1),
+	}
+
+	for i, dir := range dirs {
+		nw.Nodes = append(nw.Nodes, &Node{
+			Index: i,
+			Dir:   dir,
+			Netns: fmt.Sprintf("%s-%d", prefix, i),
+			Veth:  fmt.Sprintf("%sv%d", prefix, i),
+			Addr:  addr(uint32(i) + 2),
+		})
+	}
+
+	return nw, nil
+}
+
+// Load reads the network recorded in the testbed directory `dir`. It returns
+// nil if the testbed does not use network namespaces.
+func Load(dir string) (*Network, error) {
+	data, err := os.ReadFile(filepath.Join(dir, StateFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var nw Network
+	if err := json.Unmarshal(data, &nw); err != nil {
+		return nil, err
+	}
+
+	return &nw, nil
+}
+
+// Save records the network in the testbed directory `dir`
+func (nw *Network) Save(dir string) error {
+	fi, err := os.Create(filepath.Join(dir, StateFile))
+	if err != nil {
+		return err
+	}
+
+	defer fi.Close()
+	return json.NewEncoder(fi).Encode(nw)
+}
+
+// Remove deletes the network record from the testbed directory `dir`
+func Remove(dir string) error {
+	err := os.Remove(filepath.Join(dir, StateFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// IP returns the address of the node within its namespace, without the
+// length of the subnet
+func (n *Node) IP() string {
+	ip, _, _ := strings.Cut(n.Addr, "/")
+	return ip
+}
+
+// Node returns the namespace of node `n`
+func (nw *Network) Node(n int) (*Node, error) {
+	if n < 0 || n >= len(nw.Nodes) {
+		return nil, fmt.Errorf("node %d has no network namespace", n)
+	}
+
+	return nw.Nodes[n], nil
+}
+
+// Exec runs fn from within the namespace of the node stored at `dir`.
+// Processes started by fn, from the calling goroutine, are placed into the
+// namespace, other goroutines are not, see Do. When no namespace belongs to
+// `dir`, fn is called directly.
+func (nw *Network) Exec(dir string, fn func() error) error {
+	for _, n := range nw.Nodes {
+		if n.Dir == dir {
+			return Do(n.Netns, fn)
+		}
+	}
+
+	return fn()
+}
+
+// SetLink records the shape of traffic from node `from` to node `to`
+func (nw *Network) SetLink(from, to int, shape Shape) {
+	for _, l := range nw.Links {
+		if l.From == from && l.To == to {
+			l.Shape = shape
+			return
+		}
+	}
+
+	nw.Links = append(nw.Links, &Link{
+		From:  from,
+		To:    to,
+		Shape: shape,
+	})
+}
+
+// links returns the links leaving node `n`
+func (nw *Network) links(n int) []*Link {
+	var out []*Link
+	for _, l := range nw.Links {
+		if l.From == n && !l.Shape.Empty() {
+			out = append(out, l)
+		}
+	}
+
+	return out
+}
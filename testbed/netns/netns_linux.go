@@ -0,0 +1,339 @@
+//go:build linux
+
+package netns
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// nodeIface is the name of the interface inside of every namespace
+const nodeIface = "eth0"
+
+// netnsDir is where `ip netns` keeps named namespaces
+const netnsDir = "/var/run/netns"
+
+func run(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %s", name, strings.Join(args, " "), strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+func checkRoot() error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("network namespaces require root")
+	}
+
+	return nil
+}
+
+func linkExists(name string) bool {
+	_, err := os.Stat(filepath.Join("/sys/class/net", name))
+	return err == nil
+}
+
+func netnsExists(name string) bool {
+	_, err := os.Stat(filepath.Join(netnsDir, name))
+	return err == nil
+}
+
+// Setup creates the bridge, and a namespace attached to it for every node,
+// then applies traffic shaping
+func (nw *Network) Setup() error {
+	if err := checkRoot(); err != nil {
+		return err
+	}
+
+	cmds := [][]string{
+		{"link", "add", nw.Bridge, "type", "bridge"},
+		{"addr", "add", nw.Gateway, "dev", nw.Bridge},
+		{"link", "set", nw.Bridge, "up"},
+	}
+
+	for _, args := range cmds {
+		if err := run("ip", args...); err != nil {
+			return err
+		}
+	}
+
+	for _, n := range nw.Nodes {
+		if err := nw.setupNode(n); err != nil {
+			return err
+		}
+	}
+
+	return nw.Shape()
+}
+
+func (nw *Network) setupNode(n *Node) error {
+	gateway := strings.Split(nw.Gateway, "/")[0]
+
+	cmds := [][]string{
+		{"netns", "add", n.Netns},
+		{"link", "add", n.Veth, "type", "veth", "peer", "name", nodeIface, "netns", n.Netns},
+		{"link", "set", n.Veth, "master", nw.Bridge},
+		{"link", "set", n.Veth, "up"},
+		{"-n", n.Netns, "addr", "add", n.Addr, "dev", nodeIface},
+		{"-n", n.Netns, "link", "set", "lo", "up"},
+		{"-n", n.Netns, "link", "set", nodeIface, "up"},
+		{"-n", n.Netns, "route", "add", "default", "via", gateway},
+	}
+
+	for _, args := range cmds {
+		if err := run("ip", args...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Teardown removes every namespace, interface and bridge created by Setup.
+// Pieces which no longer exist are skipped, so Teardown can be used to clean
+// up after a partial Setup.
+func (nw *Network) Teardown() error {
+	// Nothing is left to remove after a teardown, which needs no root
+	if !nw.exists() {
+		return nil
+	}
+
+	if err := checkRoot(); err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, n := range nw.Nodes {
+		if netnsExists(n.Netns) {
+			if err := run("ip", "netns", "delete", n.Netns); err != nil {
+				errs = append(errs, err)
+			}
+		}
+
+		// Deleting the namespace normally takes the veth pair with it
+		if linkExists(n.Veth) {
+			if err := run("ip", "link", "delete", n.Veth); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	if linkExists(nw.Bridge) {
+		if err := run("ip", "link", "delete", nw.Bridge); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// exists reports whether any namespace, interface or bridge of the network
+// exists on the host
+func (nw *Network) exists() bool {
+	for _, n := range nw.Nodes {
+		if netnsExists(n.Netns) || linkExists(n.Veth) {
+			return true
+		}
+	}
+
+	return linkExists(nw.Bridge)
+}
+
+// Shape (re)applies the traffic shaping of every node and link
+func (nw *Network) Shape() error {
+	if err := checkRoot(); err != nil {
+		return err
+	}
+
+	for _, n := range nw.Nodes {
+		if err := nw.shapeNode(n); err != nil {
+			return fmt.Errorf("node[%d]: %w", n.Index, err)
+		}
+	}
+
+	return nil
+}
+
+func (nw *Network) shapeNode(n *Node) error {
+	// Start from a clean slate, the root qdisc may not exist yet
+	run("tc", "-n", n.Netns, "qdisc", "del", "dev", nodeIface, "root")
+
+	links := nw.links(n.Index)
+	if len(links) == 0 {
+		if n.Shape.Empty() {
+			return nil
+		}
+
+		return addShape(n.Netns, []string{"root"}, 10, n.Shape)
+	}
+
+	// Links are shaped by steering the traffic of each destination into its
+	// own htb class, everything else goes through class 1:1 and the node shape
+	cmds := [][]string{
+		{"qdisc", "add", "dev", nodeIface, "root", "handle", "1:", "htb", "default", "1"},
+		{"class", "add", "dev", nodeIface, "parent", "1:", "classid", "1:1", "htb", "rate", "10gbit"},
+	}
+
+	for _, args := range cmds {
+		if err := run("tc", append([]string{"-n", n.Netns}, args...)...); err != nil {
+			return err
+		}
+	}
+
+	if !n.Shape.Empty() {
+		if err := addShape(n.Netns, []string{"parent", "1:1"}, 10, n.Shape); err != nil {
+			return err
+		}
+	}
+
+	for i, l := range links {
+		to, err := nw.Node(l.To)
+		if err != nil {
+			return err
+		}
+
+		classid := fmt.Sprintf("1:%d", i+2)
+		dst := strings.Split(to.Addr, "/")[0] + "/32"
+
+		cmds := [][]string{
+			{"class", "add", "dev", nodeIface, "parent", "1:", "classid", classid, "htb", "rate", "10gbit"},
+			{"filter", "add", "dev", nodeIface, "parent", "1:", "protocol", "ip", "prio", "1", "u32", "match", "ip", "dst", dst, "flowid", classid},
+		}
+
+		for _, args := range cmds {
+			if err := run("tc", append([]string{"-n", n.Netns}, args...)...); err != nil {
+				return err
+			}
+		}
+
+		if err := addShape(n.Netns, []string{"parent", classid}, 2*(i+2)+10, l.Shape); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addShape attaches a netem qdisc, taking care of latency, jitter and loss,
+// and a tbf qdisc below it to limit bandwidth
+func addShape(ns string, parent []string, handle int, s Shape) error {
+	args := []string{"-n", ns, "qdisc", "add", "dev", nodeIface}
+	args = append(args, parent...)
+	args = append(args, "handle", fmt.Sprintf("%d:", handle), "netem")
+
+	if s.Latency != "" || s.Jitter != "" {
+		latency := s.Latency
+		if latency == "" {
+			latency = "0ms"
+		}
+
+		args = append(args, "delay", latency)
+		if s.Jitter != "" {
+			args = append(args, s.Jitter)
+		}
+	}
+
+	if s.Loss != "" {
+		args = append(args, "loss", s.Loss)
+	}
+
+	if err := run("tc", args...); err != nil {
+		return err
+	}
+
+	if s.Bandwidth == "" {
+		return nil
+	}
+
+	return run("tc", "-n", ns, "qdisc", "add", "dev", nodeIface,
+		"parent", fmt.Sprintf("%d:1", handle), "handle", fmt.Sprintf("%d:", handle+1),
+		"tbf", "rate", s.Bandwidth, "burst", "32kbit", "latency", "400ms")
+}
+
+// Do runs fn with the calling goroutine locked to a thread that has joined the
+// namespace `name`. Processes forked by fn, from the calling goroutine, inherit
+// the namespace. Work fn hands over to other goroutines, such as the dials of
+// an http client, runs in the namespace of iptb, which reaches nodes through
+// the bridge at the address they are bound to.
+func Do(name string, fn func() error) error {
+	runtime.LockOSThread()
+
+	origin, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer origin.Close()
+
+	target, err := os.Open(filepath.Join(netnsDir, name))
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("could not open network namespace: %w", err)
+	}
+	defer target.Close()
+
+	if err := unix.Setns(int(target.Fd()), unix.CLONE_NEWNET); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("could not enter network namespace %s: %w", name, err)
+	}
+
+	fnErr := fn()
+
+	// A thread which could not be moved back must never be reused, keeping
+	// it locked makes the runtime discard it once the goroutine exits
+	if err := unix.Setns(int(origin.Fd()), unix.CLONE_NEWNET); err != nil {
+		return errors.Join(fnErr, err)
+	}
+
+	runtime.UnlockOSThread()
+	return fnErr
+}
+
+// Block drops, within the namespace of node `from`, all traffic to node `to`
+func (nw *Network) Block(from, to int) error {
+	src, dst, err := nw.pair(from, to)
+	if err != nil {
+		return err
+	}
+
+	return run("ip", "-n", src.Netns, "route", "replace", "blackhole", dst)
+}
+
+// Unblock reverts Block. Traffic which was not blocked is left as is.
+func (nw *Network) Unblock(from, to int) error {
+	src, dst, err := nw.pair(from, to)
+	if err != nil {
+		return err
+	}
+
+	// ip reports a route which does not exist as "No such process"
+	err = run("ip", "-n", src.Netns, "route", "del", "blackhole", dst)
+	if err != nil && strings.Contains(err.Error(), "No such process") {
+		return nil
+	}
+
+	return err
+}
+
+func (nw *Network) pair(from, to int) (*Node, string, error) {
+	src, err := nw.Node(from)
+	if err != nil {
+		return nil, "", err
+	}
+
+	dst, err := nw.Node(to)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return src, strings.Split(dst.Addr, "/")[0] + "/32", nil
+}
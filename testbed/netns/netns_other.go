@@ -0,0 +1,27 @@
+//go:build !linux
+
+package netns
+
+func (nw *Network) Setup() error {
+	return ErrNotSupported
+}
+
+func (nw *Network) Teardown() error {
+	return ErrNotSupported
+}
+
+func (nw *Network) Shape() error {
+	return ErrNotSupported
+}
+
+func Do(name string, fn func() error) error {
+	return ErrNotSupported
+}
+
+func (nw *Network) Block(from, to int) error {
+	return ErrNotSupported
+}
+
+func (nw *Network) Unblock(from, to int) error {
+	return ErrNotSupported
+}
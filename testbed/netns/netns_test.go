@@ -0,0 +1,38 @@
+package netns
+
+import (
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	nw, err := New("/tmp/testbeds/default", []string{"/a", "/b", "/c"}, "10.77.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if nw.Gateway != "10.77.0.1/16" {
+		t.Errorf("expected gateway 10.77.0.1/16, got %s", nw.Gateway)
+	}
+
+	for i, n := range nw.Nodes {
+		if len(n.Veth) > 15 || len(nw.Bridge) > 15 {
+			t.Errorf("interface names too long: %s %s", n.Veth, nw.Bridge)
+		}
+
+		if n.Dir != []string{"/a", "/b", "/c"}[i] {
+			t.Errorf("node %d has dir %s", i, n.Dir)
+		}
+	}
+
+	if nw.Nodes[2].Addr != "10.77.0.4/16" {
+		t.Errorf("expected node 2 at 10.77.0.4/16, got %s", nw.Nodes[2].Addr)
+	}
+
+	if nw.Nodes[2].IP() != "10.77.0.4" {
+		t.Errorf("expected node 2 to listen on 10.77.0.4, got %s", nw.Nodes[2].IP())
+	}
+
+	if _, err := New("/tmp/testbeds/default", make([]string, 10), "10.77.0.0/29"); err == nil {
+		t.Errorf("expected error for a subnet too small")
+	}
+}
@@ -0,0 +1,95 @@
+package testbed
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// Partition splits nodes into groups which can not reach each other
+type Partition struct {
+	ID     int     `json:"id"`
+	Groups [][]int `json:"groups"`
+}
+
+// Separates reports whether the partition makes nodes `a` and `b` unreachable
+// from each other
+func (p *Partition) Separates(a, b int) bool {
+	ga, gb := -1, -1
+	for i, group := range p.Groups {
+		for _, n := range group {
+			if n == a {
+				ga = i
+			}
+			if n == b {
+				gb = i
+			}
+		}
+	}
+
+	return ga != -1 && gb != -1 && ga != gb
+}
+
+// Pairs returns every ordered pair of nodes separated by the partition
+func (p *Partition) Pairs() [][2]int {
+	var out [][2]int
+	for i, from := range p.Groups {
+		for j, to := range p.Groups {
+			if i == j {
+				continue
+			}
+
+			for _, a := range from {
+				for _, b := range to {
+					out = append(out, [2]int{a, b})
+				}
+			}
+		}
+	}
+
+	return out
+}
+
+// Separated returns the active partition separating nodes `a` and `b`, if any
+func Separated(parts []*Partition, a, b int) (*Partition, bool) {
+	for _, p := range parts {
+		if p.Separates(a, b) {
+			return p, true
+		}
+	}
+
+	return nil, false
+}
+
+// ReadPartitions returns the partitions recorded in the testbed directory
+// `dir`, or nil when there are none
+func ReadPartitions(dir string) ([]*Partition, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "partitions.json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var parts []*Partition
+	err = json.Unmarshal(data, &parts)
+	if err != nil {
+		return nil, err
+	}
+
+	return parts, nil
+}
+
+// WritePartitions records parts in the testbed directory `dir`, replacing the
+// partitions recorded before
+func WritePartitions(dir string, parts []*Partition) error {
+	fi, err := os.Create(filepath.Join(dir, "partitions.json"))
+	if err != nil {
+		return err
+	}
+
+	defer fi.Close()
+	return json.NewEncoder(fi).Encode(parts)
+}
@@ -0,0 +1,34 @@
+package testbed
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPartitionSeparates(t *testing.T) {
+	p := &Partition{
+		ID:     1,
+		Groups: [][]int{{0, 1}, {2}},
+	}
+
+	cases := []struct {
+		a, b     int
+		expected bool
+	}{
+		{0, 1, false},
+		{0, 2, true},
+		{2, 1, true},
+		{0, 3, false},
+	}
+
+	for _, c := range cases {
+		if got := p.Separates(c.a, c.b); got != c.expected {
+			t.Errorf("Separates(%d, %d) = %v, expected %v", c.a, c.b, got, c.expected)
+		}
+	}
+
+	expected := [][2]int{{0, 2}, {1, 2}, {2, 0}, {2, 1}}
+	if pairs := p.Pairs(); !reflect.DeepEqual(pairs, expected) {
+		t.Errorf("Pairs() = %v, expected %v", pairs, expected)
+	}
+}
@@ -0,0 +1,199 @@
+// Package proc reads the resource usage of processes, and of their children,
+// from the proc filesystem of linux.
+package proc
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Root is where the proc filesystem is mounted
+const Root = "/proc"
+
+// clockTicks is the number of clock ticks per second in which cpu times are
+// reported, which is 100 on every common linux platform
+const clockTicks = 100
+
+// Stats is the resource usage of a process and of all of its descendants
+type Stats struct {
+	CPUSeconds float64
+	RSSBytes   int64
+	Threads    int64
+	FDs        int64
+	Sockets    int64
+	ReadBytes  int64
+	WriteBytes int64
+	Processes  int64
+}
+
+// Metric describes a value of Stats
+type Metric struct {
+	Name        string
+	Description string
+	value       func(Stats) string
+}
+
+// Metrics lists the values of Stats, as metrics of nodes
+var Metrics = []Metric{
+	{"proc_cpu_seconds", "cpu time used in user and system mode, in seconds", func(s Stats) string { return strconv.FormatFloat(s.CPUSeconds, 'f', -1, 64) }},
+	{"proc_rss_bytes", "resident memory, in bytes", func(s Stats) string { return strconv.FormatInt(s.RSSBytes, 10) }},
+	{"proc_threads", "number of threads", func(s Stats) string { return strconv.FormatInt(s.Threads, 10) }},
+	{"proc_fds", "number of open file descriptors", func(s Stats) string { return strconv.FormatInt(s.FDs, 10) }},
+	{"proc_sockets", "number of open sockets", func(s Stats) string { return strconv.FormatInt(s.Sockets, 10) }},
+	{"proc_io_read_bytes", "bytes read from storage", func(s Stats) string { return strconv.FormatInt(s.ReadBytes, 10) }},
+	{"proc_io_write_bytes", "bytes written to storage", func(s Stats) string { return strconv.FormatInt(s.WriteBytes, 10) }},
+	{"proc_processes", "number of processes, the node and its children", func(s Stats) string { return strconv.FormatInt(s.Processes, 10) }},
+}
+
+// Values returns every metric of the stats, by name
+func (s Stats) Values() map[string]string {
+	values := make(map[string]string, len(Metrics))
+	for _, m := range Metrics {
+		values[m.Name] = m.value(s)
+	}
+
+	return values
+}
+
+// Read returns the resource usage of the process pid and of its descendants,
+// from the proc filesystem mounted at root. Descendants which exit while they
+// are read, or which can not be read, are left out.
+func Read(root string, pid int) (Stats, error) {
+	var stats Stats
+
+	if err := readProcess(root, pid, &stats); err != nil {
+		return stats, err
+	}
+
+	children, err := readChildren(root)
+	if err != nil {
+		return stats, err
+	}
+
+	queue := children[pid]
+	for len(queue) != 0 {
+		child := queue[0]
+		queue = append(queue[1:], children[child]...)
+
+		readProcess(root, child, &stats)
+	}
+
+	return stats, nil
+}
+
+// readProcess adds the resource usage of a single process to stats. Only the
+// stat files are required, as fds and io of processes of other users can not
+// be read.
+func readProcess(root string, pid int, stats *Stats) error {
+	dir := filepath.Join(root, strconv.Itoa(pid))
+
+	fields, err := readStat(dir)
+	if err != nil {
+		return err
+	}
+
+	// Fields start at the state, the third field of stat
+	utime, _ := strconv.ParseInt(fields[11], 10, 64)
+	stime, _ := strconv.ParseInt(fields[12], 10, 64)
+	threads, _ := strconv.ParseInt(fields[17], 10, 64)
+
+	statm, err := os.ReadFile(filepath.Join(dir, "statm"))
+	if err != nil {
+		return err
+	}
+
+	var size, resident int64
+	if _, err := fmt.Sscan(string(statm), &size, &resident); err != nil {
+		return fmt.Errorf("%s/statm: %s", dir, err)
+	}
+
+	stats.CPUSeconds += float64(utime+stime) / clockTicks
+	stats.RSSBytes += resident * int64(os.Getpagesize())
+	stats.Threads += threads
+	stats.Processes++
+
+	if fds, err := os.ReadDir(filepath.Join(dir, "fd")); err == nil {
+		for _, fd := range fds {
+			stats.FDs++
+
+			link, err := os.Readlink(filepath.Join(dir, "fd", fd.Name()))
+			if err == nil && strings.HasPrefix(link, "socket:") {
+				stats.Sockets++
+			}
+		}
+	}
+
+	if fi, err := os.Open(filepath.Join(dir, "io")); err == nil {
+		defer fi.Close()
+
+		scanner := bufio.NewScanner(fi)
+		for scanner.Scan() {
+			key, value, _ := strings.Cut(scanner.Text(), ":")
+			n, _ := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+
+			switch key {
+			case "read_bytes":
+				stats.ReadBytes += n
+			case "write_bytes":
+				stats.WriteBytes += n
+			}
+		}
+	}
+
+	return nil
+}
+
+// readStat returns the fields of the stat file of a process which follow its
+// name, as the name may hold spaces and parentheses
+func readStat(dir string) ([]string, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "stat"))
+	if err != nil {
+		return nil, err
+	}
+
+	end := strings.LastIndexByte(string(data), ')')
+	if end < 0 {
+		return nil, fmt.Errorf("%s/stat: malformed", dir)
+	}
+
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 18 {
+		return nil, fmt.Errorf("%s/stat: malformed", dir)
+	}
+
+	return fields, nil
+}
+
+// readChildren returns the children of every process
+func readChildren(root string) (map[int][]int, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+
+	children := make(map[int][]int)
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		fields, err := readStat(filepath.Join(root, entry.Name()))
+		if err != nil {
+			continue
+		}
+
+		ppid, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+
+		children[ppid] = append(children[ppid], pid)
+	}
+
+	return children, nil
+}
@@ -0,0 +1,90 @@
+package proc
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// writeProcess writes a fake process under root, with utime and stime of 150
+// ticks, a resident size of 10 pages and 2 threads
+func writeProcess(t *testing.T, root string, pid, ppid int, sockets int) {
+	dir := filepath.Join(root, strconv.Itoa(pid))
+	if err := os.MkdirAll(filepath.Join(dir, "fd"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	fields := make([]string, 50)
+	for i := range fields {
+		fields[i] = "0"
+	}
+
+	fields[0] = "S"
+	fields[1] = strconv.Itoa(ppid)
+	fields[11] = "100"
+	fields[12] = "50"
+	fields[17] = "2"
+
+	stat := strconv.Itoa(pid) + " (ipfs (daemon)) " + strings.Join(fields, " ")
+
+	files := map[string]string{
+		"stat":  stat,
+		"statm": "100 10 5 1 0 20 0",
+		"io":    "rchar: 1\nwchar: 2\nread_bytes: 4096\nwrite_bytes: 8192\n",
+	}
+
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.Symlink("/dev/null", filepath.Join(dir, "fd", "0")); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < sockets; i++ {
+		if err := os.Symlink("socket:[1234]", filepath.Join(dir, "fd", strconv.Itoa(i+1))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRead(t *testing.T) {
+	root := t.TempDir()
+
+	writeProcess(t, root, 10, 1, 2)
+	writeProcess(t, root, 11, 10, 0)
+	writeProcess(t, root, 12, 11, 1)
+	writeProcess(t, root, 20, 1, 5)
+
+	stats, err := Read(root, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Stats{
+		CPUSeconds: 4.5,
+		RSSBytes:   30 * int64(os.Getpagesize()),
+		Threads:    6,
+		FDs:        6,
+		Sockets:    3,
+		ReadBytes:  3 * 4096,
+		WriteBytes: 3 * 8192,
+		Processes:  3,
+	}
+
+	if stats != expected {
+		t.Errorf("expected %+v, got %+v", expected, stats)
+	}
+
+	if v := stats.Values()["proc_sockets"]; v != "3" {
+		t.Errorf("expected 3 sockets, got %s", v)
+	}
+
+	if _, err := Read(root, 30); err == nil {
+		t.Errorf("expected error for a missing process")
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"path/filepath"
 
 	testbedi "github.com/ipfs/iptb/testbed/interfaces"
+	"github.com/ipfs/iptb/testbed/netns"
 	iptbutil "github.com/ipfs/iptb/util"
 )
 
@@ -61,12 +62,30 @@ func AlreadyInitCheck(dir string, force bool) error {
 			return nil
 		}
 
-		return os.RemoveAll(dir)
+		return RemoveTestbed(dir)
 	}
 
 	return nil
 }
 
+// RemoveTestbed deletes the testbed stored at `dir`, along with the network
+// namespaces created for it. When the namespaces can not be removed, e.g.
+// without root, the testbed is kept so that removing it can be retried.
+func RemoveTestbed(dir string) error {
+	nw, err := netns.Load(dir)
+	if err != nil {
+		return fmt.Errorf("could not read the network of the testbed: %w", err)
+	}
+
+	if nw != nil {
+		if err := nw.Teardown(); err != nil {
+			return fmt.Errorf("could not remove the network namespaces of the testbed, it is kept: %w", err)
+		}
+	}
+
+	return os.RemoveAll(dir)
+}
+
 func BuildSpecs(base string, count int, typ string, attrs map[string]string) ([]*NodeSpec, error) {
 	var specs []*NodeSpec
 
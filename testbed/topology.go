@@ -0,0 +1,38 @@
+package testbed
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// ReadTopology returns the connections requested between nodes, as pairs of
+// node indexes ordered from the lower to the higher index
+func ReadTopology(dir string) ([][2]int, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "topology.json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var edges [][2]int
+	err = json.Unmarshal(data, &edges)
+	if err != nil {
+		return nil, err
+	}
+
+	return edges, nil
+}
+
+func WriteTopology(dir string, edges [][2]int) error {
+	fi, err := os.Create(filepath.Join(dir, "topology.json"))
+	if err != nil {
+		return err
+	}
+
+	defer fi.Close()
+	return json.NewEncoder(fi).Encode(edges)
+}